@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"cftestor/internal/config"
+
+	flag "github.com/spf13/pflag"
+)
+
+// command is one "cftestor <name>" subcommand. run gets the arguments after
+// the name and returns the exit code.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"scan", "Find and verify the best edge nodes (the default without a command)", runScan},
+		{"fetch", "Fetch active Cloudflare IPv4/IPv6 CIDRs or CDN domains", runFetch},
+		{"history", "Show earlier results stored in a SQLite file", runHistory},
+		{"export", "Export earlier results from a SQLite file as CSV or JSON", runExport},
+		{"serve", "Serve earlier results from a SQLite file over HTTP as JSON", runServe},
+		{"inspect", "Show the candidates a scan would test, without testing them", runInspect},
+		{"merge", "Combine the CSV or SQLite results of several runs into one ranking", runMerge},
+		{"config", "Print the settings merged from --config, env and flags", runConfigCommand},
+		{"help", "Show help for a command", runHelp},
+	}
+}
+
+// runCommand dispatches on the first argument. Without a command, or when it
+// starts with a flag, the arguments are scan options, as before subcommands
+// existed.
+func runCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runScan(args)
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "error: unknown command %q\n\n", args[0])
+	printCommands()
+	return 2
+}
+
+func printCommands() {
+	fmt.Println("Usage: cftestor <command> [options]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, cmd := range commands {
+		fmt.Printf("    %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Println()
+	fmt.Println(`Run "cftestor help <command>" or "cftestor <command> -h" for its options.`)
+}
+
+func runHelp(args []string) int {
+	if len(args) == 0 {
+		printCommands()
+		return 0
+	}
+	if args[0] == "scan" {
+		fmt.Print(config.Help)
+		return 0
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] && cmd.name != "help" {
+			return cmd.run([]string{"--help"})
+		}
+	}
+	fmt.Fprintf(os.Stderr, "error: unknown command %q\n", args[0])
+	return 2
+}
+
+// newCommandFlagSet returns a flag set for a subcommand that prints help
+// on -h.
+func newCommandFlagSet(name, help string) *flag.FlagSet {
+	fs := flag.NewFlagSet("cftestor "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Print(help)
+	}
+	return fs
+}
+
+// parseCommandFlags parses args into fs. When it returns false the command
+// should exit with the returned code, after -h or a bad flag.
+func parseCommandFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0, false
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2, false
+	}
+	return 0, true
+}
+
+// initCommandLogger sets the log level for subcommands that do not go
+// through config.ConfigureApp.
+func initCommandLogger(debug, silence bool) {
+	config.Config.Debug = debug
+	config.Config.SilenceMode = silence
+	config.InitLoggerFromConfig()
+}
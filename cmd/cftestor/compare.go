@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"cftestor/internal/config"
+	"cftestor/internal/logger"
+	"cftestor/internal/outbound"
+)
+
+const (
+	// a variant is flagged when it is this much worse than the best one on the same IP
+	throttleDelayFactor = 1.5
+	throttleSpeedFactor = 0.5
+)
+
+// probeVariant is one way of re-probing the qualified IPs. apply switches the
+// global config and returns a function that restores it.
+type probeVariant struct {
+	name  string
+	apply func() (restore func())
+}
+
+// runVariantComparison retests ips once per variant. The workers must still be
+// running; they read the config per task, so switching it between rounds is safe.
+func runVariantComparison(ips []string, variants []probeVariant) map[string]map[string]config.VerifyResults {
+	results := make(map[string]map[string]config.VerifyResults, len(ips))
+	store := func(name string, r config.VerifyResults) {
+		if _, ok := results[*r.IP]; !ok {
+			results[*r.IP] = make(map[string]config.VerifyResults)
+		}
+		results[*r.IP][name] = r
+	}
+	// put the whole config back even if a round bails out before its restore
+	saved := config.Config
+	defer func() { config.Config = saved }()
+	for _, variant := range variants {
+		logger.Log.Infof("Comparing %s on %d IPs...", variant.name, len(ips))
+		restore := variant.apply()
+		batch := make([]*string, 0, len(ips))
+		for i := range ips {
+			batch = append(batch, &ips[i])
+		}
+		dtResults := make(map[string]config.VerifyResults)
+		if !config.Config.DLTOnly {
+			dltBatch := make([]*string, 0, len(ips))
+			runDTSingleRound(batch, func(res config.SingleVerifyResult) {
+				r := calcResult(res, false)
+				store(variant.name, r)
+				if validDTResult(&r) {
+					dtResults[*r.IP] = r
+					t_ip := *r.IP
+					dltBatch = append(dltBatch, &t_ip)
+				}
+			})
+			batch = dltBatch
+		}
+		if !config.Config.DTOnly {
+			runDLTSingleRound(batch, func(res config.SingleVerifyResult) {
+				r := calcResult(res, true)
+				if v, ok := dtResults[*r.IP]; ok {
+					r.Combine(v)
+				}
+				store(variant.name, r)
+			})
+		}
+		restore()
+	}
+	return results
+}
+
+// findThrottled returns, per IP, the variants that did much worse than the
+// best variant on that IP, or failed while another one passed.
+func findThrottled(results map[string]map[string]config.VerifyResults, names []string) map[string][]string {
+	throttled := make(map[string][]string)
+	for ip, byVariant := range results {
+		bestDelay, bestSpeed := 0.0, 0.0
+		for _, r := range byVariant {
+			if r.Da > 0 && (bestDelay == 0 || r.Da < bestDelay) {
+				bestDelay = r.Da
+			}
+			if r.Dls > bestSpeed {
+				bestSpeed = r.Dls
+			}
+		}
+		if bestDelay == 0 && bestSpeed == 0 {
+			continue
+		}
+		for _, name := range names {
+			r := byVariant[name]
+			slow := !config.Config.DLTOnly && bestDelay > 0 && (r.Da <= 0 || r.Da > bestDelay*throttleDelayFactor)
+			if !config.Config.DTOnly && bestSpeed > 0 && r.Dls < bestSpeed*throttleSpeedFactor {
+				slow = true
+			}
+			if slow {
+				throttled[ip] = append(throttled[ip], name)
+			}
+		}
+	}
+	return throttled
+}
+
+// printVariantMatrix prints one row per IP and one column per variant. With
+// phases, delays are split into handshake+TTFB.
+func printVariantMatrix(title string, results map[string]map[string]config.VerifyResults, names []string, phases bool) {
+	ips := make([]string, 0, len(results))
+	for ip := range results {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	throttled := findThrottled(results, names)
+
+	logger.Log.Println()
+	logger.Log.Println(title + ":")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	header := "IP"
+	for _, name := range names {
+		header += "\t" + name
+	}
+	fmt.Fprintln(w, header+"\t")
+	for _, ip := range ips {
+		line := ip
+		for _, name := range names {
+			line += "\t" + formatVariantCell(results[ip][name], slices.Contains(throttled[ip], name), phases)
+		}
+		fmt.Fprintln(w, line+"\t")
+	}
+	fmt.Fprintln(w, "")
+	w.Flush()
+	if phases {
+		logger.Log.Println("Delays are shown as handshake+time to first byte.")
+	}
+
+	counts := make(map[string]int)
+	for _, variants := range throttled {
+		for _, name := range variants {
+			counts[name]++
+		}
+	}
+	for _, name := range names {
+		if counts[name] > 0 {
+			logger.Log.Printf("%s: much worse than the best on %d/%d IPs (*)\n", name, counts[name], len(ips))
+		}
+	}
+}
+
+func formatVariantCell(r config.VerifyResults, flagged, phases bool) string {
+	cell := "fail"
+	if r.Da > 0 || r.Dls > 0 {
+		parts := make([]string, 0, 2)
+		if !config.Config.DLTOnly {
+			if phases && r.HandshakeAvg > 0 {
+				parts = append(parts, fmt.Sprintf("%.0f+%.0fms", r.HandshakeAvg, r.TTFBAvg))
+			} else {
+				parts = append(parts, fmt.Sprintf("%.0fms", r.Da))
+			}
+		}
+		if !config.Config.DTOnly {
+			parts = append(parts, fmt.Sprintf("%.0fKB/s", r.Dls))
+		}
+		cell = strings.Join(parts, " ")
+	}
+	if flagged {
+		cell += " *"
+	}
+	return cell
+}
+
+func fingerprintVariants(set []config.TLSFingerprint) []probeVariant {
+	variants := make([]probeVariant, 0, len(set))
+	for _, fp := range set {
+		variants = append(variants, probeVariant{
+			name: fp.Name,
+			apply: func() func() {
+				clientID, userAgent := config.Config.TLSClientID, config.Config.UserAgent
+				config.Config.TLSClientID = fp.ClientID
+				if len(fp.UserAgent) > 0 {
+					config.Config.UserAgent = fp.UserAgent
+				}
+				return func() {
+					config.Config.TLSClientID, config.Config.UserAgent = clientID, userAgent
+				}
+			},
+		})
+	}
+	return variants
+}
+
+func runFingerprintComparison() {
+	set := config.Config.CompareFingerprintSet
+	if len(set) == 0 || len(config.VerifyResultsMap) == 0 {
+		return
+	}
+	ips := make([]string, 0, len(config.VerifyResultsMap))
+	for ip := range config.VerifyResultsMap {
+		ips = append(ips, ip)
+	}
+	names := make([]string, 0, len(set))
+	for _, fp := range set {
+		names = append(names, fp.Name)
+	}
+	results := runVariantComparison(ips, fingerprintVariants(set))
+	printVariantMatrix("Fingerprint comparison", results, names, false)
+}
+
+// betterResult reports whether r beats b: a faster download, or a lower
+// delay without DLT or when the speeds are equal.
+func betterResult(r, b config.VerifyResults) bool {
+	if !config.Config.DTOnly && r.Dls != b.Dls {
+		return r.Dls > b.Dls
+	}
+	return r.Da > 0 && (b.Da <= 0 || r.Da < b.Da)
+}
+
+// bestVariant picks the fastest download, or the lowest delay without DLT.
+func bestVariant(byVariant map[string]config.VerifyResults, names []string) (string, bool) {
+	best, found := "", false
+	for _, name := range names {
+		r, ok := byVariant[name]
+		if !ok || (r.Da <= 0 && r.Dls <= 0) {
+			continue
+		}
+		if !found || betterResult(r, byVariant[best]) {
+			best, found = name, true
+		}
+	}
+	return best, found
+}
+
+// pathDTResults is the DT result of every scanned candidate on every outbound
+// path, keyed by IP and then by path name.
+var pathDTResults = make(map[string]map[string]config.VerifyResults)
+
+func pathNames(paths []outbound.OutboundPath) []string {
+	names := make([]string, 0, len(paths))
+	for _, p := range paths {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// bestDTPath returns the path on which ip passed DT best, or the first path
+// if it failed on all of them.
+func bestDTPath(ip string, names []string) string {
+	passed := make(map[string]config.VerifyResults)
+	for name, r := range pathDTResults[ip] {
+		if validDTResult(&r) {
+			passed[name] = r
+		}
+	}
+	if name, ok := bestVariant(passed, names); ok {
+		return name
+	}
+	return names[0]
+}
+
+// runScanDTRound runs the DT stage of a scan batch and hands one result per IP
+// to handler. With --via-interfaces or --via-marks every candidate is tested
+// over every path. All results are kept in pathDTResults, and handler gets the
+// one of the IP's best path, so an IP qualifies if any path reaches it.
+func runScanDTRound(batch []*string, handler func(config.VerifyResults)) {
+	paths := outbound.OutboundPaths()
+	if len(paths) == 0 {
+		runDTSingleRound(batch, func(res config.SingleVerifyResult) {
+			handler(calcResult(res, false))
+		})
+		return
+	}
+	for _, p := range paths {
+		restore := p.Apply()
+		runDTSingleRound(batch, func(res config.SingleVerifyResult) {
+			r := calcResult(res, false)
+			if _, ok := pathDTResults[*r.IP]; !ok {
+				pathDTResults[*r.IP] = make(map[string]config.VerifyResults)
+			}
+			pathDTResults[*r.IP][p.Name] = r
+		})
+		restore()
+	}
+	names := pathNames(paths)
+	for _, ip := range batch {
+		r := pathDTResults[*ip][bestDTPath(*ip, names)]
+		if !validDTResult(&r) {
+			// only qualified IPs are compared later; keep big scans small
+			delete(pathDTResults, *ip)
+		}
+		handler(r)
+	}
+}
+
+// runScanDLTRound runs the DLT stage of a scan batch. With several outbound
+// paths each IP is downloaded over the path it passed DT best on.
+func runScanDLTRound(batch []*string, handler func(config.SingleVerifyResult)) {
+	paths := outbound.OutboundPaths()
+	if len(paths) == 0 {
+		runDLTSingleRound(batch, handler)
+		return
+	}
+	names := pathNames(paths)
+	for _, p := range paths {
+		group := make([]*string, 0, len(batch))
+		for _, ip := range batch {
+			if bestDTPath(*ip, names) == p.Name {
+				group = append(group, ip)
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+		restore := p.Apply()
+		runDLTSingleRound(group, handler)
+		restore()
+	}
+}
+
+// runPathDLTComparison downloads from the qualified IPs over every path they
+// passed DT on during the scan, and joins each download with that path's DT
+// result.
+func runPathDLTComparison(ips []string, paths []outbound.OutboundPath) map[string]map[string]config.VerifyResults {
+	results := make(map[string]map[string]config.VerifyResults, len(ips))
+	for _, ip := range ips {
+		results[ip] = make(map[string]config.VerifyResults, len(paths))
+		for name, r := range pathDTResults[ip] {
+			results[ip][name] = r
+		}
+	}
+	if config.Config.DTOnly {
+		return results
+	}
+	saved := config.Config
+	defer func() { config.Config = saved }()
+	for _, p := range paths {
+		batch := make([]*string, 0, len(ips))
+		for i := range ips {
+			if r, ok := results[ips[i]][p.Name]; ok && validDTResult(&r) {
+				batch = append(batch, &ips[i])
+			}
+		}
+		logger.Log.Infof("Comparing %s on %d IPs...", p.Name, len(batch))
+		restore := p.Apply()
+		runDLTSingleRound(batch, func(res config.SingleVerifyResult) {
+			r := calcResult(res, true)
+			r.Combine(results[*r.IP][p.Name])
+			results[*r.IP][p.Name] = r
+		})
+		restore()
+	}
+	return results
+}
+
+// runPathComparison prints the qualified IPs per outbound path, ranks them on
+// each path and recommends the best path per IP. DT comes from the scan,
+// which tested every candidate over every path; DLT is rerun per path. With
+// --dlt-only the scan had no DT stage, so the IPs are retested in full.
+func runPathComparison() {
+	paths := outbound.OutboundPaths()
+	if len(paths) == 0 || len(config.VerifyResultsMap) == 0 {
+		return
+	}
+	ips := make([]string, 0, len(config.VerifyResultsMap))
+	for ip := range config.VerifyResultsMap {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	names := pathNames(paths)
+	var results map[string]map[string]config.VerifyResults
+	if config.Config.DLTOnly {
+		variants := make([]probeVariant, 0, len(paths))
+		for _, p := range paths {
+			variants = append(variants, probeVariant{name: p.Name, apply: p.Apply})
+		}
+		results = runVariantComparison(ips, variants)
+	} else {
+		results = runPathDLTComparison(ips, paths)
+	}
+	printVariantMatrix("Per-path results", results, names, false)
+
+	for _, name := range names {
+		ranked := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			if r := results[ip][name]; r.Da > 0 || r.Dls > 0 {
+				ranked = append(ranked, ip)
+			}
+		}
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return betterResult(results[ranked[i]][name], results[ranked[j]][name])
+		})
+		logger.Log.Printf("Ranking over %s (%d/%d IPs passed):\n", name, len(ranked), len(ips))
+		for i, ip := range ranked {
+			logger.Log.Printf("  %d. %s (%s)\n", i+1, ip, formatVariantCell(results[ip][name], false, false))
+		}
+	}
+
+	logger.Log.Println("Best path per IP:")
+	wins := make(map[string]int)
+	for _, ip := range ips {
+		name, ok := bestVariant(results[ip], names)
+		if !ok {
+			logger.Log.Printf("  %s -> none (failed on every path)\n", ip)
+			continue
+		}
+		wins[name]++
+		logger.Log.Printf("  %s -> %s (%s)\n", ip, name, formatVariantCell(results[ip][name], false, false))
+	}
+	for _, name := range names {
+		logger.Log.Printf("%s is the best path for %d/%d IPs\n", name, wins[name], len(ips))
+	}
+}
+
+func transportVariant(name string, h3 bool) probeVariant {
+	return probeVariant{
+		name: name,
+		apply: func() func() {
+			dt, dlt := config.Config.DTHTTP3, config.Config.DLTHTTP3
+			config.Config.DTHTTP3 = h3 && config.Config.DTHttps
+			config.Config.DLTHTTP3 = h3
+			return func() {
+				config.Config.DTHTTP3, config.Config.DLTHTTP3 = dt, dlt
+			}
+		},
+	}
+}
+
+// runTransportComparison retests the qualified IPs over TCP and over QUIC when
+// --dt-via h3 or --dlt-proto h3 is used, so both transports show up side by
+// side for the same IP.
+func runTransportComparison() {
+	if !config.UsesHTTP3() || len(config.VerifyResultsMap) == 0 {
+		return
+	}
+	ips := make([]string, 0, len(config.VerifyResultsMap))
+	for ip := range config.VerifyResultsMap {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	names := []string{"TCP", "QUIC"}
+	variants := []probeVariant{transportVariant("TCP", false), transportVariant("QUIC", true)}
+	results := runVariantComparison(ips, variants)
+	printVariantMatrix("TCP/QUIC comparison", results, names, !config.Config.DLTOnly && config.Config.DTHttps)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"cftestor/internal/config"
+
+	flag "github.com/spf13/pflag"
+)
+
+const configHelp = `Usage: cftestor config dump [options]
+
+Print the settings a run with the same options would use, after merging
+flags, CFTESTOR_* environment variables, the --profile section of --config,
+the rest of --config, and the defaults, in that order of precedence. The
+output is a TOML file that --config accepts; each value is marked with where
+it came from, and settings left at their defaults are commented out. URL
+passwords, such as the one of --proxy, and Authorization, Proxy-Authorization
+and Cookie header values are printed as xxxxx.
+`
+
+// runConfigCommand implements "cftestor config" and returns the exit code.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Print(configHelp)
+		if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
+			return 0
+		}
+		return 2
+	}
+	if err := config.DumpConfig(os.Stdout, args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"cftestor/internal/config"
+	"cftestor/internal/fetcher"
+	"cftestor/internal/logger"
+	"cftestor/internal/utils"
+)
+
+const (
+	fetchIPv4    = "ipv4"
+	fetchIPv6    = "ipv6"
+	fetchDomains = "domains"
+)
+
+const fetchHelp = `Usage: cftestor fetch ipv4|ipv6|domains [options]
+
+Fetch the Cloudflare IPv4 or IPv6 CIDRs that currently serve popular sites, or
+the top Tranco domains behind the Cloudflare CDN, one per line. The CIDR lists
+can be fed back to a scan with "-i".
+
+Options:
+    -o, --out-file     string     Write to this file instead of stdout.
+        --dns          string     DNS server for resolving the Tranco domains (e.g. 1.1.1.1:53,
+                                  tls://1.1.1.1, https://1.1.1.1/dns-query). Default: 1.1.1.1:53.
+        --tranco-limit int        Number of top Tranco domains to check. Default: 1000.
+    -V, --debug                   Print detailed debug logs.
+    -h, --help                    Show this help message.
+
+The scan flags --fetch-ipv4, --fetch-ipv6 and --fetch-cf-domains still work but
+are deprecated.
+`
+
+// runFetch implements "cftestor fetch" and returns the exit code.
+func runFetch(args []string) int {
+	defaults := config.DefaultConfig()
+	var outFile string
+	var debug bool
+	dnsServer, trancoLimit := defaults.DNSServer, defaults.TrancoLimit
+	fs := newCommandFlagSet("fetch", fetchHelp)
+	fs.StringVarP(&outFile, "out-file", "o", "", "Write to this file instead of stdout.")
+	fs.StringVar(&dnsServer, "dns", dnsServer, "DNS server for resolving the Tranco domains.")
+	fs.IntVar(&trancoLimit, "tranco-limit", trancoLimit, "Number of top Tranco domains to check.")
+	fs.BoolVarP(&debug, "debug", "V", false, "Print detailed debug logs.")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fmt.Print(fetchHelp)
+		return 2
+	}
+	kind := fs.Arg(0)
+	switch kind {
+	case fetchIPv4, fetchIPv6, fetchDomains:
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown fetch target %q, must be ipv4, ipv6 or domains\n", kind)
+		return 2
+	}
+	if trancoLimit <= 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid value for %q: %d, must be > 0\n", "--tranco-limit", trancoLimit)
+		return 2
+	}
+	// progress logs share stdout, so keep them out of a list written there
+	initCommandLogger(debug, len(outFile) == 0 && !debug)
+	return fetchToFile(kind, outFile, dnsServer, trancoLimit)
+}
+
+// fetchToFile fetches kind and writes one entry per line to filePath, or to
+// stdout if filePath is empty.
+func fetchToFile(kind, filePath, dnsServer string, trancoLimit int) int {
+	var lines []string
+	var err error
+	var what string
+	switch kind {
+	case fetchDomains:
+		what = "Cloudflare CDN domains"
+		logger.Log.Infof("Starting dynamic Cloudflare CDN domain fetch...")
+		lines, err = fetcher.FetchCloudflareDomains(dnsServer, trancoLimit)
+	case fetchIPv4:
+		what = "IPv4 CIDRs"
+		logger.Log.Infof("Starting dynamic IPv4 fetch...")
+		lines, err = fetcher.FetchDynamicIPv4(dnsServer, trancoLimit)
+	case fetchIPv6:
+		what = "IPv6 CIDRs"
+		logger.Log.Infof("Starting dynamic IPv6 fetch...")
+		lines, err = fetcher.FetchDynamicIPv6(dnsServer, trancoLimit)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: fetch failed: %v\n", err)
+		return 1
+	}
+	if len(filePath) == 0 {
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return 0
+	}
+	if err := utils.WriteStringsToFile(filePath, lines); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to save fetched %s: %v\n", what, err)
+		return 1
+	}
+	logger.Log.Infof("Successfully saved %d %s to %s", len(lines), what, filePath)
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cftestor/internal/config"
+	"cftestor/internal/db"
+
+	flag "github.com/spf13/pflag"
+)
+
+const recordQueryOptions = `    -f, --db-file      string     SQLite results file. Default: ` + config.DefaultDBFile + `.
+    -q, --query        string     SQL WHERE clause for the rows, e.g. "DLS > 5000 AND LOC = 'HKG'".
+    -g, --label        string     Only rows with this label.
+        --since        string     Only rows tested at or after this time, e.g. "2026-10-18" or "2026-10-18 08:00".
+        --best                    Keep the newest row per IP and rank them by speed, then delay, as
+                                  "cftestor merge" does. Default: all rows, newest first.
+`
+
+const historyHelp = `Usage: cftestor history [options]
+
+Show earlier results stored by "--to-db", newest first.
+
+Options:
+` + recordQueryOptions + `    -r, --result       int        Show at most N rows; 0 shows all. Default: 20.
+    -S, --silence                 Print only the IPs.
+    -h, --help                    Show this help message.
+`
+
+const exportHelp = `Usage: cftestor export [options]
+
+Export earlier results stored by "--to-db" as CSV, in the layout "--to-file"
+writes, or as a JSON array.
+
+Options:
+` + recordQueryOptions + `    -r, --result       int        Export at most N rows; 0 exports all. Default: 0.
+        --format       string     Output format: csv or json. Default: csv.
+    -o, --out-file     string     Write to this file instead of stdout. A CSV file that already exists is
+                                  appended to, as with "--to-file".
+    -h, --help                    Show this help message.
+`
+
+// recordQuery holds the row selection flags shared by history and export.
+type recordQuery struct {
+	dbFile string
+	filter db.RecordFilter
+	best   bool
+}
+
+func (q *recordQuery) register(fs *flag.FlagSet, limit int) {
+	q.filter.Limit = limit
+	fs.StringVarP(&q.dbFile, "db-file", "f", config.DefaultDBFile, "SQLite results file.")
+	fs.StringVarP(&q.filter.Where, "query", "q", "", "SQL WHERE clause for the rows.")
+	fs.StringVarP(&q.filter.Label, "label", "g", "", "Only rows with this label.")
+	fs.StringVar(&q.filter.Since, "since", "", "Only rows tested at or after this time.")
+	fs.BoolVar(&q.best, "best", false, "Keep the newest row per IP, ranked by speed, then delay.")
+	fs.IntVarP(&q.filter.Limit, "result", "r", limit, "Maximum number of rows; 0 means all.")
+}
+
+func (q *recordQuery) load() ([]db.DBRecord, error) {
+	if q.filter.Limit < 0 {
+		return nil, fmt.Errorf("invalid value for %q: %d, must be >= 0", "--result", q.filter.Limit)
+	}
+	filter := q.filter
+	if q.best {
+		// rank every matching row before applying the limit
+		filter.Limit = 0
+	}
+	records, err := db.QueryRecords(q.dbFile, filter)
+	if err != nil {
+		return nil, err
+	}
+	if q.best {
+		records = db.MergeRecords(records)
+		if q.filter.Limit > 0 && q.filter.Limit < len(records) {
+			records = records[:q.filter.Limit]
+		}
+	}
+	return records, nil
+}
+
+// runHistory implements "cftestor history" and returns the exit code.
+func runHistory(args []string) int {
+	var q recordQuery
+	var silence bool
+	fs := newCommandFlagSet("history", historyHelp)
+	q.register(fs, 20)
+	fs.BoolVarP(&silence, "silence", "S", false, "Print only the IPs.")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	records, err := q.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if silence {
+		printRecordIPs(records)
+		return 0
+	}
+	fmt.Printf("%d result(s) from %s:\n", len(records), q.dbFile)
+	printRecordTable(records)
+	return 0
+}
+
+// runExport implements "cftestor export" and returns the exit code.
+func runExport(args []string) int {
+	var q recordQuery
+	var format, outFile string
+	fs := newCommandFlagSet("export", exportHelp)
+	q.register(fs, 0)
+	fs.StringVar(&format, "format", "csv", "Output format: csv or json.")
+	fs.StringVarP(&outFile, "out-file", "o", "", "Write to this file instead of stdout.")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format != "csv" && format != "json" {
+		fmt.Fprintf(os.Stderr, "error: invalid value for %q: %q, must be csv or json\n", "--format", format)
+		return 2
+	}
+	records, err := q.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if format == "csv" && len(outFile) > 0 {
+		// a CSV file gets the BOM and header of --to-file output
+		if err := db.WriteCSVResult(records, outFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	var out io.Writer = os.Stdout
+	if len(outFile) > 0 {
+		fp, err := os.Create(outFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to create %q: %v\n", outFile, err)
+			return 1
+		}
+		defer func() { _ = fp.Close() }()
+		out = fp
+	}
+	if format == "csv" {
+		err = db.WriteCSV(out, records, true)
+	} else {
+		if records == nil {
+			records = []db.DBRecord{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(records)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to export results: %v\n", err)
+		return 1
+	}
+	return 0
+}
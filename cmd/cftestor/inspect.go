@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"cftestor/internal/config"
+	"cftestor/internal/db"
+	"cftestor/internal/utils"
+
+	flag "github.com/spf13/pflag"
+)
+
+const inspectHelp = `Usage: cftestor inspect [scan options] [--list N]
+
+Load the candidate pool exactly as "cftestor scan" would with the same options,
+including -s, -i, --in-db, -p, exclusions, --sampling, --seed and --shard, and
+print its size and the first candidates the scan would test, without testing
+them. With the same --seed, a scan then starts with the listed candidates.
+
+Options:
+        --list         int        Number of candidates to list. Default: 20.
+    -h, --help                    Show this help message.
+
+Every scan option is accepted; see "cftestor scan -h".
+`
+
+// runInspect implements "cftestor inspect" and returns the exit code.
+func runInspect(args []string) int {
+	list := 20
+	config.DBSourceLoader = db.LoadInputRecords
+	opts, shouldExit, exitCode, err := config.ConfigureAppWith(args, func(fs *flag.FlagSet) {
+		fs.Usage = func() {
+			fmt.Print(inspectHelp)
+		}
+		fs.IntVar(&list, "list", list, "Number of candidates to list.")
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	if opts.PrintVersion {
+		print_version()
+		return 0
+	}
+	if shouldExit {
+		return exitCode
+	}
+	if list < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid value for %q: %d, must be >= 0\n", "--list", list)
+		return 2
+	}
+
+	src := config.SrcIPs
+	count := utils.FormatHostCount(src.TotalHosts())
+	if src.Streaming() {
+		count += "+ (streamed input, not read to the end)"
+	}
+	var families []string
+	if config.Config.IPv4Mode {
+		families = append(families, "IPv4")
+	}
+	if config.Config.IPv6Mode {
+		families = append(families, "IPv6")
+	}
+	sampling := config.Config.Sampling
+	if config.Config.TestAll {
+		sampling = "in order (--test-all)"
+	} else if sampling == config.SamplingStratified {
+		sampling += fmt.Sprintf(", %d per block", config.Config.StratifyK)
+	}
+	fmt.Printf("Candidates: %s\n", count)
+	fmt.Printf("Families:   %s\n", strings.Join(families, ", "))
+	fmt.Printf("Ports:      %s\n", strings.Trim(strings.ReplaceAll(fmt.Sprint(src.Ports), " ", ","), "[]"))
+	fmt.Printf("Sampling:   %s\n", sampling)
+	fmt.Printf("Seed:       %d\n", config.Config.Seed)
+	if config.Config.ShardCount > 1 {
+		fmt.Printf("Shard:      %d/%d (the count above is for all shards)\n", config.Config.ShardIndex, config.Config.ShardCount)
+	}
+	if list == 0 {
+		return 0
+	}
+
+	// draw in the batch size the scan uses, so the listed order matches it
+	batchSize := config.Config.DTWorkerThread
+	if config.Config.DLTOnly {
+		batchSize = config.Config.DLTWorkerThread
+	}
+	var candidates []string
+	for len(candidates) < list {
+		batch := src.RetrieveSome(batchSize, !config.Config.TestAll)
+		if len(batch) == 0 {
+			break
+		}
+		for _, host := range batch {
+			candidates = append(candidates, *host)
+		}
+	}
+	if len(candidates) > list {
+		candidates = candidates[:list]
+	}
+	fmt.Printf("\nFirst %d candidate(s):\n", len(candidates))
+	for _, host := range candidates {
+		fmt.Println(host)
+	}
+	return 0
+}
@@ -5,12 +5,12 @@ import (
 	"math/big"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"cftestor/internal/config"
 	"cftestor/internal/db"
-	"cftestor/internal/fetcher"
 	"cftestor/internal/logger"
 	"cftestor/internal/outbound"
 	"cftestor/internal/ping"
@@ -110,12 +110,25 @@ func calcResult(out config.SingleVerifyResult, statDownload bool) config.VerifyR
 	tIP := out.Host
 	tVerifyResult.IP = &tIP
 	tVerifyResult.Loc = &out.Loc
+	tVerifyResult.Origin = config.HostOrigin(tIP)
 	if len(out.ResultSlice) == 0 {
 		return tVerifyResult
 	}
 	tVerifyResult.Dtc = len(out.ResultSlice)
 	var tDurationsAll = 0.0
+	var tProxyAll, tEdgeAll = 0.0, 0.0
+	var tHandshakeAll, tTTFBAll = 0.0, 0.0
 	for _, v := range out.ResultSlice {
+		if len(v.Cert.ChainSHA256) > 0 {
+			tVerifyResult.Cert = v.Cert
+		}
+		if v.StatusCode > 0 {
+			tVerifyResult.StatusCode, tVerifyResult.CFRay = v.StatusCode, v.CFRay
+		}
+		if len(v.FailReason) > 0 {
+			tVerifyResult.FailReason = v.FailReason
+		}
+		tVerifyResult.AddSourceAddr(v.SourceAddr)
 		if v.DTPassed {
 			tVerifyResult.Dtpc += 1
 			tDuration := float64(v.DTDuration) / float64(time.Millisecond)
@@ -123,7 +136,14 @@ func calcResult(out config.SingleVerifyResult, statDownload bool) config.VerifyR
 				tDuration += float64(v.HttpReqRspDur) / float64(time.Millisecond)
 			}
 			tVerifyResult.DtDList = append(tVerifyResult.DtDList, tDuration)
+			if len(v.Proto) > 0 {
+				tVerifyResult.Proto = v.Proto
+			}
 			tDurationsAll += tDuration
+			tProxyAll += float64(v.ProxyDuration) / float64(time.Millisecond)
+			tEdgeAll += float64(v.EdgeDuration) / float64(time.Millisecond)
+			tHandshakeAll += float64(v.DTDuration) / float64(time.Millisecond)
+			tTTFBAll += float64(v.HttpReqRspDur) / float64(time.Millisecond)
 			if tDuration > tVerifyResult.Dmx {
 				tVerifyResult.Dmx = tDuration
 			}
@@ -142,6 +162,12 @@ func calcResult(out config.SingleVerifyResult, statDownload bool) config.VerifyR
 	}
 	if tVerifyResult.Dtpc > 0 {
 		tVerifyResult.Da = tDurationsAll / float64(tVerifyResult.Dtpc)
+		tVerifyResult.ProxyAvg = tProxyAll / float64(tVerifyResult.Dtpc)
+		tVerifyResult.EdgeAvg = tEdgeAll / float64(tVerifyResult.Dtpc)
+		if tTTFBAll > 0 {
+			tVerifyResult.HandshakeAvg = tHandshakeAll / float64(tVerifyResult.Dtpc)
+			tVerifyResult.TTFBAvg = tTTFBAll / float64(tVerifyResult.Dtpc)
+		}
 		tVerifyResult.Dtpr = float64(tVerifyResult.Dtpc) / float64(tVerifyResult.Dtc)
 		if config.Config.EnableStdEv {
 			tVerifyResult.DaVar = utils.Variance(tVerifyResult.DtDList)
@@ -174,14 +200,32 @@ func printDetails(logLvl logger.LogLevel, v []config.VerifyResults, showSpeed bo
 			t_ip = fmt.Sprintf("%s#%s", t_ip, *v[i].Loc)
 		}
 		msg := fmt.Sprintf("IP:%v%s", t_ip, indent)
+		if len(v[i].Origin) > 0 {
+			msg += fmt.Sprintf("Host:%s%s", v[i].Origin, indent)
+		}
 		if showSpeed {
 			msg += fmt.Sprintf("Spd:%.2f%s", v[i].Dls, indent)
 		}
 		msg += fmt.Sprintf("Dly:%.0f", v[i].Da)
+		if v[i].ProxyAvg > 0 {
+			msg += fmt.Sprintf("%sProxy:%.0f%sEdge:%.0f", indent, v[i].ProxyAvg, indent, v[i].EdgeAvg)
+		}
+		if len(v[i].SourceAddrs) > 0 {
+			msg += fmt.Sprintf("%sSrc:%s", indent, strings.Join(v[i].SourceAddrs, ","))
+		}
+		if len(v[i].Proto) > 0 {
+			msg += fmt.Sprintf("%sProto:%s", indent, v[i].Proto)
+		}
+		if front := v[i].Fronting(); len(front) > 0 {
+			msg += fmt.Sprintf("%sFront:%s", indent, front)
+		}
 		msg += fmt.Sprintf("%sStb:%.2f", indent, v[i].Dtpr*100)
 		if config.Config.EnableStdEv {
 			msg += fmt.Sprintf("%sStd:%.2f", indent, v[i].DaStd)
 		}
+		if len(v[i].FailReason) > 0 {
+			msg += fmt.Sprintf("%sFail:%s", indent, v[i].FailReason)
+		}
 		logger.Log.Logf(logLvl, "%s", msg)
 	}
 }
@@ -223,17 +267,15 @@ func elapsed(start time.Time) string {
 	return fmt.Sprintf("[+%ds]", int(time.Since(start).Seconds()))
 }
 
-func runWorker() {
+func runWorker(start_time time.Time) {
 	initWorkers()
 
 	var thisSourceIPs = config.SrcIPs
 	var t_result_min = config.Config.ResultMin
-	var start_time = time.Now()
 
 	// Determine starting IP source level
-	hasUserSources := len(config.IPStr) > 0 || len(config.Config.IPFile) > 0
 	currentSourceLevel := config.SourceLevelFull
-	if hasUserSources {
+	if config.HasUserSources() {
 		currentSourceLevel = config.SourceLevelUser
 	} else if config.Config.FastMode {
 		currentSourceLevel = config.SourceLevelFast
@@ -247,7 +289,14 @@ func runWorker() {
 		tMode |= config.TypeIPv6
 	}
 
-	logger.Log.Infof("%s Starting test with %s source IPs (target: %d results)", elapsed(start_time), utils.FormatHostCount(thisSourceIPs.TotalHosts()), t_result_min)
+	sourceCount := utils.FormatHostCount(thisSourceIPs.TotalHosts())
+	if thisSourceIPs.Streaming() {
+		sourceCount += "+"
+	}
+	if config.Config.ShardCount > 1 {
+		sourceCount += fmt.Sprintf(", shard %d/%d", config.Config.ShardIndex, config.Config.ShardCount)
+	}
+	logger.Log.Infof("%s Starting test with %s source IPs (target: %d results, seed: %d)", elapsed(start_time), sourceCount, t_result_min, config.Config.Seed)
 
 RETRY_LOOP:
 	for {
@@ -298,9 +347,8 @@ RETRY_LOOP:
 					batchDTPassed := 0
 
 					logger.Log.Infof("%s DT batch: testing %d IPs...", elapsed(start_time), len(dtBatch))
-					runDTSingleRound(dtBatch, func(dtRes config.SingleVerifyResult) {
+					runScanDTRound(dtBatch, func(tVerifyResult config.VerifyResults) {
 						dtDoneTasks++
-						tVerifyResult := calcResult(dtRes, false)
 						t_ip := *tVerifyResult.IP
 
 						if validDTResult(&tVerifyResult) {
@@ -352,7 +400,7 @@ RETRY_LOOP:
 						if len(dltBatch) > 0 {
 							batchDLTPassed := 0
 							logger.Log.Infof("%s DLT batch: testing %d IPs...", elapsed(start_time), len(dltBatch))
-							runDLTSingleRound(dltBatch, func(dltRes config.SingleVerifyResult) {
+							runScanDLTRound(dltBatch, func(dltRes config.SingleVerifyResult) {
 								dltDoneTasks++
 								tVerifyResult := calcResult(dltRes, true)
 								t_ip := *tVerifyResult.IP
@@ -470,6 +518,8 @@ RETRY_LOOP:
 				for k := range tmpResultMap {
 					tmp_slice = append(tmp_slice, k)
 				}
+				// map order is random; sort so --seed replays the same retest
+				sort.Strings(tmp_slice)
 				newSourceIPs := config.NewSourceIPs()
 				if err := newSourceIPs.AddFromSlice(tmp_slice, config.TypeIPv4|config.TypeIPv6); err != nil {
 					logger.Log.Errorf("failed to prepare loop candidates: %v\n", err)
@@ -524,7 +574,9 @@ RETRY_LOOP:
 		
 		t_result_min = config.Config.ResultMin - len(config.VerifyResultsMap)
 	}
+}
 
+func stopWorkers(start_time time.Time) {
 	logger.Log.Infof("%s Shutting down workers...", elapsed(start_time))
 	if dtTaskChan != nil {
 		close(dtTaskChan)
@@ -536,7 +588,14 @@ RETRY_LOOP:
 }
 
 func main() {
-	opts, shouldExit, exitCode, err := config.ConfigureApp(os.Args[1:])
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// runScan implements "cftestor scan", which is also what runs when no
+// command is given, and returns the exit code.
+func runScan(args []string) int {
+	config.DBSourceLoader = db.LoadInputRecords
+	opts, shouldExit, exitCode, err := config.ConfigureApp(args)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 	}
@@ -544,63 +603,47 @@ func main() {
 		if !config.Config.SilenceMode {
 			print_version()
 		}
-		os.Exit(0)
+		return 0
 	}
 	if shouldExit {
-		os.Exit(exitCode)
+		return exitCode
 	}
 
 	if err := outbound.PrepareOutboundOptions(&opts); err != nil {
 		logger.Log.Errorf("Outbound preparation failed: %v", err)
-		os.Exit(1)
-	}
-
-	if len(config.Config.FetchCFDomainsFile) > 0 {
-		logger.Log.Infof("Starting dynamic Cloudflare CDN domain fetch...")
-		domains, err := fetcher.FetchCloudflareDomains(config.Config.DNSServer, config.Config.TrancoLimit)
-		if err != nil {
-			logger.Log.Errorf("Domain fetch failed: %v", err)
-			os.Exit(1)
+		return 1
+	}
+
+	// deprecated shortcuts for "cftestor fetch"
+	for _, legacy := range []struct{ flag, kind, file string }{
+		{"--fetch-cf-domains", fetchDomains, config.Config.FetchCFDomainsFile},
+		{"--fetch-ipv4", fetchIPv4, config.Config.FetchIPv4File},
+		{"--fetch-ipv6", fetchIPv6, config.Config.FetchIPv6File},
+	} {
+		if len(legacy.file) > 0 {
+			logger.Log.Warningf("deprecated flag %q; use \"cftestor fetch %s -o %s\" instead", legacy.flag, legacy.kind, legacy.file)
+			return fetchToFile(legacy.kind, legacy.file, config.Config.DNSServer, config.Config.TrancoLimit)
 		}
-		if err := utils.WriteStringsToFile(config.Config.FetchCFDomainsFile, domains); err != nil {
-			logger.Log.Errorf("Failed to save fetched domains: %v", err)
-			os.Exit(1)
-		}
-		logger.Log.Infof("Successfully saved %d Cloudflare CDN domains to %s", len(domains), config.Config.FetchCFDomainsFile)
-		os.Exit(0)
 	}
 
-	if len(config.Config.FetchIPv4File) > 0 {
-		logger.Log.Infof("Starting dynamic IPv4 fetch...")
-		cidrs, err := fetcher.FetchDynamicIPv4(config.Config.DNSServer, config.Config.TrancoLimit)
-		if err != nil {
-			logger.Log.Errorf("Fetch failed: %v", err)
-			os.Exit(1)
-		}
-		if err := utils.WriteStringsToFile(config.Config.FetchIPv4File, cidrs); err != nil {
-			logger.Log.Errorf("Failed to save fetched IPs: %v", err)
-			os.Exit(1)
-		}
-		logger.Log.Infof("Successfully saved %d IPv4 CIDRs to %s", len(cidrs), config.Config.FetchIPv4File)
-		os.Exit(0)
+	if len(config.Config.SNIMatrix) > 0 {
+		runSNIMatrix()
+		return 0
 	}
 
-	if len(config.Config.FetchIPv6File) > 0 {
-		logger.Log.Infof("Starting dynamic IPv6 fetch...")
-		cidrs, err := fetcher.FetchDynamicIPv6(config.Config.DNSServer, config.Config.TrancoLimit)
-		if err != nil {
-			logger.Log.Errorf("Fetch failed: %v", err)
-			os.Exit(1)
-		}
-		if err := utils.WriteStringsToFile(config.Config.FetchIPv6File, cidrs); err != nil {
-			logger.Log.Errorf("Failed to save fetched IPs: %v", err)
-			os.Exit(1)
-		}
-		logger.Log.Infof("Successfully saved %d IPv6 CIDRs to %s", len(cidrs), config.Config.FetchIPv6File)
-		os.Exit(0)
+	if paths := outbound.OutboundPaths(); len(paths) > 0 {
+		// DT and DLT switch paths themselves; everything else, such as trace
+		// lookups and --dlt-only scans, goes over the first one
+		paths[0].Apply()
+		logger.Log.Infof("Testing DT over %d outbound paths; DLT runs over the best one per IP", len(paths))
 	}
 
-	runWorker()
+	start_time := time.Now()
+	runWorker(start_time)
+	runFingerprintComparison()
+	runPathComparison()
+	runTransportComparison()
+	stopWorkers(start_time)
 
 	if len(config.VerifyResultsMap) > 0 {
 		verifyResultsSlice := make([]config.VerifyResults, 0)
@@ -611,6 +654,9 @@ func main() {
 			}
 			verifyResultsSlice = append(verifyResultsSlice, v)
 		}
+		if n := config.MarkCertOutliers(verifyResultsSlice); n > 0 {
+			logger.Log.Warningf("%d result(s) presented a certificate chain different from the majority; possible interception\n", n)
+		}
 		var records []db.DBRecord
 		if config.Config.StoreToFile || config.Config.StoreToDB {
 			records = db.GenDBRecords(verifyResultsSlice, config.Config.ResolveLocalASNAndCity)
@@ -620,7 +666,7 @@ func main() {
 				}
 				if err := db.WriteCSVResult(records, config.Config.ResultFile); err != nil {
 					fmt.Fprintf(os.Stderr, "error: %v\n", err)
-					os.Exit(1)
+					return 1
 				}
 				if !config.Config.SilenceMode {
 					logger.Log.Println("  Done")
@@ -632,7 +678,7 @@ func main() {
 				}
 				if err := db.SaveDBRecords(records, config.Config.DBFile); err != nil {
 					fmt.Fprintf(os.Stderr, "error: %v\n", err)
-					os.Exit(1)
+					return 1
 				}
 				if !config.Config.SilenceMode {
 					logger.Log.Println("  Done")
@@ -644,10 +690,12 @@ func main() {
 			logger.Log.Println()
 			logger.Log.Println("All Results:")
 			db.PrintFinalStat(verifyResultsSlice, config.Config.DTOnly, false)
+			logger.Log.Printf("Seed: %d (repeat this sample with --seed %d)\n", config.Config.Seed, config.Config.Seed)
 		} else {
 			if config.Config.Loop > 0 {
 				db.PrintFinalStat(verifyResultsSlice, config.Config.DTOnly, true)
 			}
 		}
 	}
+	return 0
 }
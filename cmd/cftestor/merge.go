@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"cftestor/internal/db"
+)
+
+const mergeHelp = `Usage: cftestor merge [options] FILE...
+
+Combine the CSV or SQLite results of several runs, such as the shards of one
+"--shard i/n" scan, into one ranked result set. An IP found in more than one
+file keeps its most recent record. Results are ranked by download speed, then
+by average delay.
+
+Options:
+    -r, --result       int        Print only the top N results; 0 prints all. Default: 0.
+    -o, --out-file     string     Also write the merged results to this CSV file.
+    -f, --db-file      string     Also write the merged results to this SQLite file.
+    -S, --silence                 Print only the ranked IPs.
+    -h, --help                    Show this help message.
+`
+
+// runMerge implements "cftestor merge" and returns the exit code.
+func runMerge(args []string) int {
+	var top int
+	var outFile, dbFile string
+	var silence bool
+	fs := newCommandFlagSet("merge", mergeHelp)
+	fs.IntVarP(&top, "result", "r", 0, "Print only the top N results; 0 prints all.")
+	fs.StringVarP(&outFile, "out-file", "o", "", "Also write the merged results to this CSV file.")
+	fs.StringVarP(&dbFile, "db-file", "f", "", "Also write the merged results to this SQLite file.")
+	fs.BoolVarP(&silence, "silence", "S", false, "Print only the ranked IPs.")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		fmt.Fprintln(os.Stderr, "error: merge needs at least one CSV or SQLite result file")
+		return 2
+	}
+	if top < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid value for %q: %d, must be >= 0\n", "--result", top)
+		return 2
+	}
+	for _, out := range []string{outFile, dbFile} {
+		for _, in := range inputs {
+			if len(out) > 0 && filepath.Clean(out) == filepath.Clean(in) {
+				fmt.Fprintf(os.Stderr, "error: output file %q is also an input\n", out)
+				return 2
+			}
+		}
+	}
+
+	sets := make([][]db.DBRecord, 0, len(inputs))
+	for _, in := range inputs {
+		records, err := db.LoadResults(in)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		sets = append(sets, records)
+	}
+	merged := db.MergeRecords(sets...)
+	if len(outFile) > 0 {
+		if err := db.WriteCSVResult(merged, outFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+	if len(dbFile) > 0 {
+		if err := db.SaveDBRecords(merged, dbFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+	if top > 0 && top < len(merged) {
+		merged = merged[:top]
+	}
+	if silence {
+		printRecordIPs(merged)
+		return 0
+	}
+	fmt.Printf("Merged results from %d file(s):\n", len(inputs))
+	printRecordTable(merged)
+	return 0
+}
+
+func printRecordIPs(records []db.DBRecord) {
+	for _, r := range records {
+		line := r.IP
+		if len(r.Loc) > 0 {
+			line += "#" + r.Loc
+		}
+		fmt.Println(line)
+	}
+}
+
+func printRecordTable(records []db.DBRecord) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintln(w, "#\tTime\tIP\tSpd(KB/s)\tDly-Avg(ms)\tDT-P(%)\tDLT-P(%)\tProto\tLabel\tSeed\t")
+	for i, r := range records {
+		ip := r.IP
+		if len(r.Loc) > 0 {
+			ip += "#" + r.Loc
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%.0f\t%.0f\t%.2f\t%.2f\t%s\t%s\t%d\t\n",
+			i+1, r.TestTimeStr, ip, r.DLS, r.DA, r.DTPR*100, r.DLTPR*100, r.Proto, r.Label, r.Seed)
+	}
+	fmt.Fprintln(w, "")
+	w.Flush()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cftestor/internal/config"
+	"cftestor/internal/db"
+	"cftestor/internal/logger"
+)
+
+const serveHelp = `Usage: cftestor serve [options]
+
+Serve earlier results stored by "--to-db" over HTTP, for dashboards or for
+other machines that want the current best edge nodes.
+
+Endpoints:
+    GET /results                  JSON array of rows, newest first. Query parameters: label, since
+                                  (e.g. 2026-10-18), limit (default 20, 0 for all), and best=true for
+                                  the newest row per IP ranked by speed, then delay.
+    GET /healthz                  Returns "ok".
+
+Options:
+    -f, --db-file      string     SQLite results file. Default: ` + config.DefaultDBFile + `.
+        --listen       string     Address to listen on. Default: 127.0.0.1:8080.
+    -V, --debug                   Log every request.
+    -h, --help                    Show this help message.
+`
+
+// runServe implements "cftestor serve" and returns the exit code.
+func runServe(args []string) int {
+	var dbFile, listen string
+	var debug bool
+	fs := newCommandFlagSet("serve", serveHelp)
+	fs.StringVarP(&dbFile, "db-file", "f", config.DefaultDBFile, "SQLite results file.")
+	fs.StringVar(&listen, "listen", "127.0.0.1:8080", "Address to listen on.")
+	fs.BoolVarP(&debug, "debug", "V", false, "Log every request.")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	initCommandLogger(debug, false)
+	// fail early on a missing file rather than on the first request
+	if _, err := db.QueryRecords(dbFile, db.RecordFilter{Limit: 1}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           newResultsHandler(dbFile),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Log.Infof("Serving results from %s on http://%s/results", dbFile, listen)
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func newResultsHandler(dbFile string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /results", func(w http.ResponseWriter, r *http.Request) {
+		logger.Log.Debugf("%s %s", r.RemoteAddr, r.URL)
+		params := r.URL.Query()
+		// no raw SQL here; label and since are bound as parameters
+		q := recordQuery{dbFile: dbFile, filter: db.RecordFilter{
+			Label: params.Get("label"),
+			Since: params.Get("since"),
+			Limit: 20,
+		}}
+		if limit := params.Get("limit"); len(limit) > 0 {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			q.filter.Limit = n
+		}
+		if best := params.Get("best"); len(best) > 0 {
+			var err error
+			if q.best, err = strconv.ParseBool(best); err != nil {
+				http.Error(w, "invalid best", http.StatusBadRequest)
+				return
+			}
+		}
+		records, err := q.load()
+		if err != nil {
+			logger.Log.Errorf("Query failed: %v", err)
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+		if records == nil {
+			records = []db.DBRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(records)
+	})
+	return mux
+}
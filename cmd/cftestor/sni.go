@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"cftestor/internal/config"
+	"cftestor/internal/logger"
+	"cftestor/internal/ping"
+)
+
+func sniLabel(sni string) string {
+	if sni == "" {
+		return "<none>"
+	}
+	return sni
+}
+
+type sniMatrixRow struct {
+	host    string
+	delays  map[string]float64
+	passed  map[string]bool
+	verdict string
+	blocked []string
+}
+
+func probeSNIMatrix(host string, snis []string) sniMatrixRow {
+	row := sniMatrixRow{host: host, delays: make(map[string]float64), passed: make(map[string]bool)}
+	for _, sni := range snis {
+		d, ok := ping.ProbeSNI(host, sni)
+		row.passed[sniLabel(sni)] = ok
+		if ok {
+			row.delays[sniLabel(sni)] = float64(d.Milliseconds())
+		}
+	}
+	row.verdict, row.blocked = ping.ClassifySNI(row.passed)
+	return row
+}
+
+func (row sniMatrixRow) verdictText() string {
+	if len(row.blocked) > 0 {
+		return row.verdict + ": " + strings.Join(row.blocked, ",")
+	}
+	return row.verdict
+}
+
+// runSNIMatrixRound probes a batch of candidates in parallel and hands each
+// row to handler as soon as that candidate is done, like runDTSingleRound.
+func runSNIMatrixRound(batch []*string, snis []string, handler func(sniMatrixRow)) {
+	rowChan := make(chan sniMatrixRow, len(batch))
+	for _, host := range batch {
+		go func() { rowChan <- probeSNIMatrix(*host, snis) }()
+	}
+	for range batch {
+		handler(<-rowChan)
+	}
+}
+
+// runSNIMatrix probes up to --result candidates (all of them with --test-all)
+// with every --sni-matrix SNI. Candidates are drawn and probed one batch of
+// --dt-thread at a time, each verdict is logged as it comes in, and the
+// whole matrix is printed at the end.
+func runSNIMatrix() {
+	snis := config.Config.SNIMatrix
+	limit := config.Config.ResultMin
+	rows := make([]sniMatrixRow, 0)
+	for config.Config.TestAll || len(rows) < limit {
+		amount := config.Config.DTWorkerThread
+		if !config.Config.TestAll {
+			amount = min(amount, limit-len(rows))
+		}
+		batch := config.SrcIPs.RetrieveSome(amount, !config.Config.TestAll)
+		if len(batch) == 0 {
+			break
+		}
+		logger.Log.Infof("SNI matrix: probing %d candidates with %d SNIs...", len(batch), len(snis))
+		runSNIMatrixRound(batch, snis, func(row sniMatrixRow) {
+			rows = append(rows, row)
+			logger.Log.Infof("%s %s", row.host, row.verdictText())
+		})
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].host < rows[j].host })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	header := "IP"
+	for _, sni := range snis {
+		header += "\t" + sniLabel(sni)
+	}
+	fmt.Fprintln(w, header+"\tVerdict\t")
+	counts := make(map[string]int)
+	for _, row := range rows {
+		line := row.host
+		for _, sni := range snis {
+			if row.passed[sniLabel(sni)] {
+				line += fmt.Sprintf("\t%.0fms", row.delays[sniLabel(sni)])
+			} else {
+				line += "\tfail"
+			}
+		}
+		fmt.Fprintln(w, line+"\t"+row.verdictText()+"\t")
+		counts[row.verdict]++
+	}
+	fmt.Fprintln(w, "")
+	w.Flush()
+	logger.Log.Infof("SNI matrix: %d %s, %d %s, %d %s", counts[ping.SNIVerdictHealthy], ping.SNIVerdictHealthy,
+		counts[ping.SNIVerdictSNIBlock], ping.SNIVerdictSNIBlock, counts[ping.SNIVerdictIPBlock], ping.SNIVerdictIPBlock)
+}
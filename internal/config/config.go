@@ -1,11 +1,17 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"math/big"
+	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -32,6 +38,13 @@ type CliOptions struct {
 	DTTimeoutChanged bool
 	MarkChanged      bool
 	XMarkChanged     bool
+	DNSChanged       bool
+	SeedChanged      bool
+	ConfigFile       string
+	Profile          string
+	// Sources maps each flag set by a flag, the environment or --config
+	// to where it came from
+	Sources map[string]string
 }
 
 func DefaultConfig() AppConfig {
@@ -47,6 +60,7 @@ func DefaultConfig() AppConfig {
 		DTTimeout:                   2000,
 		DTStdExp:                    30,
 		HostName:                    DefaultTestHost,
+		DTMethod:                    http.MethodGet,
 		DLTUrl:                      DefaultDLTUrl,
 		DTUrl:                       DefaultDTUrl,
 		DLTTimeout:                  5000,
@@ -56,6 +70,8 @@ func DefaultConfig() AppConfig {
 		DTEvaluationDTPR:            100,
 		DLTEvaluationSpeed:          6000,
 		DTVia:                       "https",
+		HTTPVersion:                 "auto",
+		DLTProto:                    "tcp",
 		DTHttpRspReturnCodeExpected: 200,
 		IPv4Mode:                    true,
 		IPv6Mode:                    true,
@@ -63,11 +79,20 @@ func DefaultConfig() AppConfig {
 		UserAgent:                   UserAgentChrome,
 		PortStrSlice:                []string{},
 		DNSServer:                   "1.1.1.1:53",
+		InFormat:                    InputFormatAuto,
+		Sampling:                    SamplingUniform,
+		StratifyK:                   1,
 		TrancoLimit:                 1000,
 	}
 }
 
 func ParseCLI(args []string) (CliOptions, error) {
+	opts, _, err := parseCLI(args, nil)
+	return opts, err
+}
+
+// parseCLI parses the scan options plus any flags register adds.
+func parseCLI(args []string, register func(*flag.FlagSet)) (CliOptions, *flag.FlagSet, error) {
 	opts := CliOptions{
 		Config:    DefaultConfig(),
 		IPs:       []string{},
@@ -78,8 +103,14 @@ func ParseCLI(args []string) (CliOptions, error) {
 		fmt.Print(Help)
 	}
 	RegisterCLIFlags(fs, &opts)
+	if register != nil {
+		register(fs)
+	}
 	if err := fs.Parse(args); err != nil {
-		return opts, err
+		return opts, fs, err
+	}
+	if err := applyConfigLayers(fs, &opts); err != nil {
+		return opts, fs, err
 	}
 	opts.IPs = append(opts.IPs, opts.SourceIPs...)
 	opts.IPv4Changed = FlagChanged(fs, "ipv4")
@@ -87,13 +118,15 @@ func ParseCLI(args []string) (CliOptions, error) {
 	opts.DTTimeoutChanged = FlagChanged(fs, "dt-timeout", "dt-timeout-ms")
 	opts.MarkChanged = FlagChanged(fs, "mark")
 	opts.XMarkChanged = FlagChanged(fs, "xmark")
+	opts.DNSChanged = FlagChanged(fs, "dns")
+	opts.SeedChanged = FlagChanged(fs, "seed")
 	if opts.IPv4Changed && !opts.IPv6Changed {
 		opts.Config.IPv6Mode = false
 	} else if opts.IPv6Changed && !opts.IPv4Changed {
 		opts.Config.IPv4Mode = false
 	}
 	ApplyTLSFingerprint(&opts)
-	return opts, nil
+	return opts, fs, nil
 }
 
 func RegisterCLIFlags(fs *flag.FlagSet, opts *CliOptions) {
@@ -102,8 +135,12 @@ func RegisterCLIFlags(fs *flag.FlagSet, opts *CliOptions) {
 	fs.BoolVar(&cfg.FastMode, "fast", cfg.FastMode, "Use a limited set of internal Cloudflare IPs for quick scanning.")
 	fs.StringSliceVarP(&opts.IPs, "ip", "s", opts.IPs, "IP, CIDR, or host:port candidate to test. Can be provided multiple times.")
 	fs.StringSliceVar(&opts.SourceIPs, "source", opts.SourceIPs, "Alias for --ip.")
-	fs.StringVarP(&cfg.IPFile, "in", "i", cfg.IPFile, "Path to a file containing IPs, CIDRs, or host:port entries.")
+	fs.StringVarP(&cfg.IPFile, "in", "i", cfg.IPFile, "Path to a file containing IPs, CIDRs, or host:port entries, or - for stdin. gzip and zstd are decompressed.")
 	fs.StringVar(&cfg.IPFile, "source-file", cfg.IPFile, "Alias for --in.")
+	fs.StringVar(&cfg.InFormat, "in-format", cfg.InFormat, "Format of --in: auto, plain, csv, masscan-json, masscan-list, nmap-xml, or zmap.")
+	fs.StringVar(&cfg.InputFilter, "input-filter", cfg.InputFilter, "Filter result CSV and --in-db input, e.g. \"dls>=1000,da<200,colo=HKG|NRT\".")
+	fs.StringVar(&cfg.InDB, "in-db", cfg.InDB, "Read candidates from the CFTD table of a SQLite results file.")
+	fs.StringVar(&cfg.InDBQuery, "in-db-query", cfg.InDBQuery, "SQL WHERE clause applied to --in-db rows, e.g. \"LABEL = 'home' AND DLS > 5000\".")
 
 	fs.IntVarP(&cfg.DTWorkerThread, "dt-thread", "m", cfg.DTWorkerThread, "Number of concurrent Delay Test (DT) workers.")
 	fs.IntVar(&cfg.DTWorkerThread, "dt-workers", cfg.DTWorkerThread, "Alias for --dt-thread.")
@@ -114,12 +151,24 @@ func RegisterCLIFlags(fs *flag.FlagSet, opts *CliOptions) {
 	fs.StringSliceVarP(&cfg.PortStrSlice, "port", "p", cfg.PortStrSlice, "Port(s) for IP/CIDR inputs. Supports single ports, ranges, and lists.")
 	fs.StringVar(&cfg.HostName, "hostname", cfg.HostName, "SNI hostname for TLS/SSL DT.")
 	fs.StringVar(&cfg.HostName, "sni-hostname", cfg.HostName, "Alias for --hostname.")
-	fs.StringVar(&cfg.DTVia, "dt-via", cfg.DTVia, "Delay-test protocol: https, tls, or ssl.")
+	fs.StringSliceVar(&cfg.SNIMatrix, "sni-matrix", cfg.SNIMatrix, "Diagnose SNI filtering: handshake with every listed SNI (\"-\" for none) and classify each candidate.")
+	fs.StringVar(&cfg.SNI, "sni", cfg.SNI, "TLS SNI for HTTPS DT/DLT; the Host header still comes from the URL.")
+	fs.StringVar(&cfg.DTVia, "dt-via", cfg.DTVia, "Delay-test protocol: https, h3, tls, or ssl.")
 	fs.StringVar(&cfg.DTVia, "dt-protocol", cfg.DTVia, "Alias for --dt-via.")
+	fs.StringVar(&cfg.HTTPVersion, "http-version", cfg.HTTPVersion, "Force the ALPN offered by HTTPS probes: auto, 1.1, or 2.")
+	fs.StringSliceVar(&cfg.PinSPKI, "pin-spki", cfg.PinSPKI, "Fail DT unless the leaf SPKI SHA-256 matches one of these pins (base64 or hex).")
+	fs.StringVar(&cfg.ExpectIssuer, "expect-issuer", cfg.ExpectIssuer, "Fail DT unless the leaf certificate issuer contains this text.")
 	fs.IntVar(&cfg.DTHttpRspReturnCodeExpected, "dt-expect-code", cfg.DTHttpRspReturnCodeExpected, "HTTP status code expected for DT test.")
 	fs.IntVar(&cfg.DTHttpRspReturnCodeExpected, "dt-status-code", cfg.DTHttpRspReturnCodeExpected, "Alias for --dt-expect-code.")
 	fs.BoolVar(&cfg.DTHttps, "dt-via-https", cfg.DTHttps, "Deprecated alias for --dt-via https.")
 	fs.StringVar(&cfg.DTUrl, "dt-url", cfg.DTUrl, "URL to use for HTTPS-based DT.")
+	fs.StringVar(&cfg.DTExpectBody, "dt-expect-body", cfg.DTExpectBody, "Fail DT unless the response body matches this regular expression.")
+	fs.StringArrayVar(&cfg.DTExpectHeaders, "dt-expect-header", cfg.DTExpectHeaders, "Fail DT unless the response has this header ('Name' or 'Name: substring'). Can be provided multiple times.")
+	fs.StringVar(&cfg.DTExpectSHA256, "dt-expect-sha256", cfg.DTExpectSHA256, "Fail DT unless the response body has this SHA-256 (hex).")
+	fs.StringArrayVarP(&cfg.Headers, "header", "H", cfg.Headers, "Extra 'Name: value' header for DT/DLT requests. Can be provided multiple times.")
+	fs.StringVar(&cfg.DTMethod, "dt-method", cfg.DTMethod, "HTTP method for DT/DLT requests.")
+	fs.StringVar(&cfg.DTBody, "dt-body", cfg.DTBody, "Request body for DT/DLT requests.")
+	fs.StringVar(&cfg.DTBodyFile, "dt-body-file", cfg.DTBodyFile, "Read the DT/DLT request body from a file.")
 
 	fs.IntVarP(&cfg.DLTWorkerThread, "dlt-thread", "n", cfg.DLTWorkerThread, "Number of concurrent Download Test (DLT) workers.")
 	fs.IntVar(&cfg.DLTWorkerThread, "dlt-workers", cfg.DLTWorkerThread, "Alias for --dlt-thread.")
@@ -128,6 +177,7 @@ func RegisterCLIFlags(fs *flag.FlagSet, opts *CliOptions) {
 	fs.IntVarP(&cfg.DLTCount, "dlt-count", "b", cfg.DLTCount, "Number of DLT attempts per candidate.")
 	fs.IntVar(&cfg.DLTCount, "dlt-attempts", cfg.DLTCount, "Alias for --dlt-count.")
 	fs.StringVarP(&cfg.DLTUrl, "dlt-url", "u", cfg.DLTUrl, "URL to use for DLT.")
+	fs.StringVar(&cfg.DLTProto, "dlt-proto", cfg.DLTProto, "Download-test transport: tcp or h3.")
 	fs.IntVar(&cfg.DLTTimeout, "dlt-timeout", cfg.DLTTimeout, "HTTP response timeout for DLT in milliseconds.")
 	fs.IntVar(&cfg.DLTTimeout, "dlt-timeout-ms", cfg.DLTTimeout, "Alias for --dlt-timeout.")
 	fs.IntVarP(&cfg.Interval, "interval", "I", cfg.Interval, "Interval between test attempts in milliseconds.")
@@ -154,19 +204,30 @@ func RegisterCLIFlags(fs *flag.FlagSet, opts *CliOptions) {
 	fs.BoolVar(&cfg.DLTOnly, "dlt-only", cfg.DLTOnly, "Perform Download Test only.")
 	fs.BoolVarP(&cfg.IPv4Mode, "ipv4", "4", cfg.IPv4Mode, "Test IPv4 only.")
 	fs.BoolVarP(&cfg.IPv6Mode, "ipv6", "6", cfg.IPv6Mode, "Test IPv6 only.")
-	fs.StringVar(&cfg.FetchIPv6File, "fetch-ipv6", cfg.FetchIPv6File, "Fetch active Cloudflare IPv6 CIDRs dynamically, save to file, and exit.")
-	fs.StringVar(&cfg.FetchIPv4File, "fetch-ipv4", cfg.FetchIPv4File, "Fetch active Cloudflare IPv4 CIDRs dynamically, save to file, and exit.")
-	fs.StringVar(&cfg.FetchCFDomainsFile, "fetch-cf-domains", cfg.FetchCFDomainsFile, "Fetch, verify, and save top domains using Cloudflare CDN to a file, and exit.")
-	fs.StringVar(&cfg.DNSServer, "dns", cfg.DNSServer, "Custom DNS server for dynamic fetching (e.g. 1.1.1.1:53, tls://1.1.1.1, https://1.1.1.1/dns-query)")
+	fs.StringVar(&cfg.FetchIPv6File, "fetch-ipv6", cfg.FetchIPv6File, "Deprecated, use \"cftestor fetch ipv6 -o FILE\" instead.")
+	fs.StringVar(&cfg.FetchIPv4File, "fetch-ipv4", cfg.FetchIPv4File, "Deprecated, use \"cftestor fetch ipv4 -o FILE\" instead.")
+	fs.StringVar(&cfg.FetchCFDomainsFile, "fetch-cf-domains", cfg.FetchCFDomainsFile, "Deprecated, use \"cftestor fetch domains -o FILE\" instead.")
+	fs.StringVar(&cfg.DNSServer, "dns", cfg.DNSServer, "Custom DNS server for dynamic fetching and for resolving host:port candidates (e.g. 1.1.1.1:53, tls://1.1.1.1, https://1.1.1.1/dns-query)")
+	fs.BoolVar(&cfg.ExpandHosts, "expand-hosts", cfg.ExpandHosts, "Test every A/AAAA address of each host:port candidate as its own candidate.")
 	fs.IntVar(&cfg.TrancoLimit, "tranco-limit", cfg.TrancoLimit, "Number of top Tranco domains to fetch for dynamic scanning verification.")
 	fs.BoolVarP(&cfg.TestAll, "test-all", "a", cfg.TestAll, "Test all IPs until no more IP left.")
+	fs.StringVar(&cfg.Sampling, "sampling", cfg.Sampling, "How random draws pick source ranges: uniform, weighted (by size), or stratified (per /24 or /48).")
+	fs.IntVar(&cfg.StratifyK, "stratify-k", cfg.StratifyK, "Picks per block before moving on with --sampling stratified.")
+	fs.Int64Var(&cfg.Seed, "seed", cfg.Seed, "Random seed for sampling, so a run can be repeated with the same candidates.")
+	fs.StringVar(&cfg.Shard, "shard", cfg.Shard, "Test only shard i/n of the candidates, e.g. 2/3, to split one scan across machines.")
 	fs.StringVar(&opts.Mark, "mark", opts.Mark, "Set Linux socket fwmark for outbound packets. Supports decimal and hex.")
 	fs.StringVar(&opts.XMark, "xmark", opts.XMark, "Alias for --mark.")
+	fs.StringSliceVar(&cfg.ViaInterfaces, "via-interfaces", cfg.ViaInterfaces, "Compare outbound paths: test every candidate over each interface, index, or source IP.")
+	fs.StringSliceVar(&cfg.ViaMarks, "via-marks", cfg.ViaMarks, "Compare outbound paths: test every candidate with each socket mark.")
+	fs.StringVar(&cfg.Proxy, "proxy", cfg.Proxy, "Send DT, DLT, and trace connections through socks5://[user:pass@]host:port or http://host:port (CONNECT).")
 	fs.StringVar(&cfg.OutboundInterface, "interface", cfg.OutboundInterface, "Bind outbound packets to an interface name, interface index, or local source IP.")
+	fs.StringSliceVar(&cfg.SourceIPs, "source-ips", cfg.SourceIPs, "Spread outbound connections round-robin across these local source IPs or all addresses of these interfaces.")
 	fs.BoolVar(&opts.TLSHelloFirefox, "hello-firefox", opts.TLSHelloFirefox, "Simulate Firefox TLS fingerprint.")
 	fs.BoolVar(&opts.TLSHelloChrome, "hello-chrome", opts.TLSHelloChrome, "Simulate Chrome TLS fingerprint.")
 	fs.BoolVar(&opts.TLSHelloEdge, "hello-edge", opts.TLSHelloEdge, "Simulate Edge TLS fingerprint.")
 	fs.BoolVar(&opts.TLSHelloSafari, "hello-safari", opts.TLSHelloSafari, "Simulate Safari TLS fingerprint.")
+	fs.StringSliceVar(&cfg.CompareFingerprints, "compare-fingerprints", cfg.CompareFingerprints, "Rerun qualified IPs once per TLS fingerprint and compare: chrome, firefox, edge, safari, randomized, custom.")
+	fs.StringVar(&cfg.TLSHelloSpecFile, "hello-spec", cfg.TLSHelloSpecFile, "Load a ClientHello from a JSON ClientHelloSpec or hex dump file.")
 	fs.IntVar(&cfg.TestTimeout, "test-timeout", cfg.TestTimeout, "Test timeout in minutes.")
 
 	fs.BoolVarP(&cfg.StoreToFile, "to-file", "w", cfg.StoreToFile, "Save results to a CSV file.")
@@ -188,6 +249,8 @@ func RegisterCLIFlags(fs *flag.FlagSet, opts *CliOptions) {
 	fs.BoolVar(&cfg.SilenceMode, "quiet", cfg.SilenceMode, "Alias for --silence.")
 	fs.BoolVarP(&cfg.Debug, "debug", "V", cfg.Debug, "Print debug message.")
 	fs.BoolVarP(&opts.PrintVersion, "version", "v", opts.PrintVersion, "Show version.")
+	fs.StringVar(&opts.ConfigFile, "config", opts.ConfigFile, "Read settings from a JSON, TOML, or YAML file; flags and CFTESTOR_* environment variables override it.")
+	fs.StringVar(&opts.Profile, "profile", opts.Profile, "Apply this named section of --config on top of its top-level settings.")
 }
 
 func FlagChanged(fs *flag.FlagSet, names ...string) bool {
@@ -220,9 +283,52 @@ func ApplyTLSFingerprint(opts *CliOptions) {
 	}
 }
 
+// ParseFingerprints maps --compare-fingerprints names to the fingerprints
+// ApplyTLSFingerprint knows about, plus randomized and the --hello-spec one.
+func ParseFingerprints(names []string) ([]TLSFingerprint, error) {
+	set := make([]TLSFingerprint, 0, len(names))
+	seen := make(map[string]bool)
+	for _, raw := range names {
+		name := strings.ToLower(strings.TrimSpace(raw))
+		if name == "" || seen[name] {
+			continue
+		}
+		var fp TLSFingerprint
+		switch name {
+		case "chrome":
+			fp = TLSFingerprint{ClientID: utls.HelloChrome_Auto, UserAgent: UserAgentChrome}
+		case "firefox":
+			fp = TLSFingerprint{ClientID: utls.HelloFirefox_Auto, UserAgent: UserAgentFirefox}
+		case "edge":
+			fp = TLSFingerprint{ClientID: utls.HelloEdge_Auto, UserAgent: UserAgentEdge}
+		case "safari":
+			fp = TLSFingerprint{ClientID: utls.HelloSafari_Auto, UserAgent: UserAgentSafari}
+		case "randomized", "random":
+			name = "randomized"
+			fp = TLSFingerprint{ClientID: utls.HelloRandomized}
+		case "custom":
+			if len(Config.TLSHelloSpecFile) == 0 {
+				return nil, fmt.Errorf("invalid value for %q: %q needs %q", "--compare-fingerprints", "custom", "--hello-spec")
+			}
+			fp = TLSFingerprint{ClientID: utls.HelloCustom}
+		default:
+			return nil, fmt.Errorf("invalid value for %q: unknown fingerprint %q; use chrome, firefox, edge, safari, randomized, or custom", "--compare-fingerprints", raw)
+		}
+		fp.Name = name
+		seen[name] = true
+		set = append(set, fp)
+	}
+	return set, nil
+}
+
+// HasUserSources reports whether candidates come from -s, -i or --in-db
+// rather than the built-in ranges.
+func HasUserSources() bool {
+	return len(IPStr) > 0 || len(Config.IPFile) > 0 || len(Config.InDB) > 0
+}
+
 func LoadSourceIPs(tMode int8, ipv4Changed, ipv6Changed bool) error {
-	hasUserSources := len(IPStr) > 0 || len(Config.IPFile) > 0
-	if !hasUserSources {
+	if !HasUserSources() {
 		if (tMode & TypeIPv4) == TypeIPv4 {
 			tCFIPv4 := CFIPV4FULL
 			if Config.FastMode {
@@ -274,32 +380,242 @@ func LoadSourceIPs(tMode int8, ipv4Changed, ipv6Changed bool) error {
 			return err
 		}
 	}
+	if len(Config.InDB) != 0 {
+		if DBSourceLoader == nil {
+			return fmt.Errorf("%q is not supported by this build", "--in-db")
+		}
+		records, err := DBSourceLoader(Config.InDB, Config.InDBQuery)
+		if err != nil {
+			return err
+		}
+		if err := SrcIPs.AddFromRecords(records, tMode); err != nil {
+			return err
+		}
+	}
 	if SrcIPs.LenInt() == 0 {
 		return fmt.Errorf("no source IPs provided")
 	}
 	return nil
 }
 
+// SeedRandom reseeds MyRand, the source of every sampling decision.
+func SeedRandom(seed int64) {
+	MyRand = rand.New(rand.NewSource(seed))
+}
 
 func ResetRuntimeState() {
 	VerifyResultsMap = make(map[string]VerifyResults)
 	MyRand = utils.NewRand()
 	SrcIPs = NewSourceIPsWithRand(MyRand)
+	resetHostOrigins()
 }
 
 func NormalizeDTVia() error {
 	Config.DTVia = strings.ToLower(Config.DTVia)
+	Config.DTHTTP3 = false
 	switch Config.DTVia {
 	case "https":
 		Config.DTHttps = true
+	case "h3", "http3", "quic":
+		Config.DTVia = "h3"
+		Config.DTHttps = true
+		Config.DTHTTP3 = true
 	case "ssl", "tls":
 		Config.DTHttps = false
 	default:
-		return fmt.Errorf("invalid value for \"--dt-via\": use one of https, tls, or ssl")
+		return fmt.Errorf("invalid value for \"--dt-via\": use one of https, h3, tls, or ssl")
+	}
+	return nil
+}
+
+func NormalizeDLTProto() error {
+	switch strings.ToLower(strings.TrimSpace(Config.DLTProto)) {
+	case "", "tcp":
+		Config.DLTProto = "tcp"
+		Config.DLTHTTP3 = false
+	case "h3", "http3", "quic":
+		Config.DLTProto = "h3"
+		Config.DLTHTTP3 = true
+	default:
+		return fmt.Errorf("invalid value for \"--dlt-proto\": use one of tcp or h3")
 	}
 	return nil
 }
 
+// UsesHTTP3 reports whether DT or DLT probes run over QUIC.
+func UsesHTTP3() bool {
+	return (!Config.DLTOnly && Config.DTHTTP3) || (!Config.DTOnly && Config.DLTHTTP3)
+}
+
+// validateHTTP3 rejects options that cannot apply to QUIC probes.
+func validateHTTP3() error {
+	if !UsesHTTP3() {
+		return nil
+	}
+	if len(Config.Proxy) > 0 {
+		return fmt.Errorf("%q cannot carry QUIC (UDP) probes; drop it or use \"--dt-via https\" and \"--dlt-proto tcp\"", "--proxy")
+	}
+	tcpProbes := (!Config.DLTOnly && !Config.DTHTTP3) || (!Config.DTOnly && !Config.DLTHTTP3)
+	if Config.HTTPVersion != "auto" && !tcpProbes {
+		return fmt.Errorf("%q only applies to TCP probes, but every probe runs over HTTP/3", "--http-version")
+	}
+	if len(Config.CompareFingerprints) > 0 && !tcpProbes {
+		return fmt.Errorf("%q only applies to TCP probes, but every probe runs over HTTP/3", "--compare-fingerprints")
+	}
+	return nil
+}
+
+func NormalizeHTTPVersion() error {
+	switch strings.ToLower(strings.TrimSpace(Config.HTTPVersion)) {
+	case "", "auto":
+		Config.HTTPVersion = "auto"
+	case "1.1", "http/1.1", "h1":
+		Config.HTTPVersion = "1.1"
+	case "2", "h2", "http/2":
+		Config.HTTPVersion = "2"
+	default:
+		return fmt.Errorf("invalid value for \"--http-version\": use one of auto, 1.1, or 2")
+	}
+	return nil
+}
+
+// PrepareRequestOptions parses --header, --dt-method and the request body
+// options into RequestHeaders and RequestBody.
+func PrepareRequestOptions() error {
+	Config.RequestHeaders = make(http.Header)
+	for _, raw := range Config.Headers {
+		name, value, ok := strings.Cut(raw, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("invalid value for %q: %q must look like 'Name: value'", "--header", raw)
+		}
+		Config.RequestHeaders.Add(name, strings.TrimSpace(value))
+	}
+	method := strings.ToUpper(strings.TrimSpace(Config.DTMethod))
+	if method == "" {
+		method = http.MethodGet
+	}
+	if strings.ContainsAny(method, " \t/:") {
+		return fmt.Errorf("invalid value for %q: %q is not an HTTP method", "--dt-method", Config.DTMethod)
+	}
+	Config.DTMethod = method
+	Config.DTBodyFile = strings.TrimSpace(Config.DTBodyFile)
+	if len(Config.DTBody) > 0 && len(Config.DTBodyFile) > 0 {
+		return fmt.Errorf("%q and %q cannot be provided at the same time", "--dt-body", "--dt-body-file")
+	}
+	Config.RequestBody = nil
+	if len(Config.DTBody) > 0 {
+		Config.RequestBody = []byte(Config.DTBody)
+	} else if len(Config.DTBodyFile) > 0 {
+		body, err := os.ReadFile(Config.DTBodyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %q file %q: %w", "--dt-body-file", Config.DTBodyFile, err)
+		}
+		Config.RequestBody = body
+	}
+	return nil
+}
+
+// PrepareDTExpectations validates the DT response checks.
+func PrepareDTExpectations() error {
+	Config.DTExpectBodyRe = nil
+	if len(Config.DTExpectBody) > 0 {
+		re, err := regexp.Compile(Config.DTExpectBody)
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %w", "--dt-expect-body", err)
+		}
+		Config.DTExpectBodyRe = re
+	}
+	for _, expect := range Config.DTExpectHeaders {
+		name, _, _ := strings.Cut(expect, ":")
+		if name = strings.TrimSpace(name); name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("invalid value for %q: %q must look like 'Name' or 'Name: value'", "--dt-expect-header", expect)
+		}
+	}
+	Config.DTExpectSHA256 = strings.ToLower(strings.TrimSpace(Config.DTExpectSHA256))
+	if len(Config.DTExpectSHA256) > 0 {
+		if sum, err := hex.DecodeString(Config.DTExpectSHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid value for %q: %q is not a hex SHA-256 digest", "--dt-expect-sha256", Config.DTExpectSHA256)
+		}
+	}
+	return nil
+}
+
+// DTExpectsBody reports whether a DT check needs the response body.
+func DTExpectsBody() bool {
+	return Config.DTExpectBodyRe != nil || len(Config.DTExpectSHA256) > 0
+}
+
+// NormalizeSNIMatrix dedupes --sni-matrix and maps "-", "none" and "empty"
+// to the empty SNI.
+func NormalizeSNIMatrix() error {
+	if len(Config.SNIMatrix) == 0 {
+		return nil
+	}
+	snis := make([]string, 0, len(Config.SNIMatrix))
+	seen := make(map[string]bool)
+	for _, raw := range Config.SNIMatrix {
+		sni := strings.ToLower(strings.TrimSpace(raw))
+		switch sni {
+		case "-", "none", "empty":
+			sni = ""
+		}
+		if sni != "" && !utils.IsValidDNSHost(sni) {
+			return fmt.Errorf("invalid value for %q: %q is not a hostname", "--sni-matrix", raw)
+		}
+		if seen[sni] {
+			continue
+		}
+		seen[sni] = true
+		snis = append(snis, sni)
+	}
+	if len(snis) < 2 {
+		return fmt.Errorf("invalid value for %q: at least two SNIs are needed to tell IP and SNI blocking apart", "--sni-matrix")
+	}
+	Config.SNIMatrix = snis
+	return nil
+}
+
+// NormalizePinSPKI rewrites --pin-spki values to standard base64. Pins may be
+// given as "sha256/<base64>", plain base64, or 64 hex digits.
+func NormalizePinSPKI() error {
+	pins := make([]string, 0, len(Config.PinSPKI))
+	for _, raw := range Config.PinSPKI {
+		pin := strings.TrimPrefix(strings.TrimSpace(raw), "sha256/")
+		if pin == "" {
+			continue
+		}
+		var sum []byte
+		if len(pin) == 2*sha256.Size {
+			sum, _ = hex.DecodeString(pin)
+		}
+		if sum == nil {
+			decoded, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("invalid value for %q: %q is not a SHA-256 pin in base64 or hex", "--pin-spki", raw)
+			}
+			sum = decoded
+		}
+		pins = append(pins, base64.StdEncoding.EncodeToString(sum))
+	}
+	Config.PinSPKI = pins
+	Config.ExpectIssuer = strings.TrimSpace(Config.ExpectIssuer)
+	return nil
+}
+
+// ForcedALPN returns the ALPN protocol list that replaces the fingerprint's
+// own list, or nil when --http-version is auto.
+func ForcedALPN() []string {
+	switch Config.HTTPVersion {
+	case "1.1":
+		return []string{"http/1.1"}
+	case "2":
+		return []string{"h2"}
+	default:
+		return nil
+	}
+}
+
 func PrintVersionInfo() {
 	fmt.Println(AppArt)
 	fmt.Println(`  CF CDN IP scanner, find best IPs for you.
@@ -313,7 +629,13 @@ func PrintVersionInfo() {
 }
 
 func ConfigureApp(args []string) (CliOptions, bool, int, error) {
-	opts, err := ParseCLI(args)
+	return ConfigureAppWith(args, nil)
+}
+
+// ConfigureAppWith is ConfigureApp for commands that take the scan options
+// plus flags of their own, which register adds to the flag set.
+func ConfigureAppWith(args []string, register func(*flag.FlagSet)) (CliOptions, bool, int, error) {
+	opts, _, err := parseCLI(args, register)
 	if err != nil {
 		if err == flag.ErrHelp {
 			return opts, true, 0, nil
@@ -324,7 +646,10 @@ func ConfigureApp(args []string) (CliOptions, bool, int, error) {
 	Config = opts.Config
 	IPStr = opts.IPs
 	VerifyResultsMap = make(map[string]VerifyResults)
-	utils.InitRandSeed(MyRand)
+	if !opts.SeedChanged {
+		Config.Seed = time.Now().UnixNano()
+	}
+	SeedRandom(Config.Seed)
 	SrcIPs = NewSourceIPsWithRand(MyRand)
 
 	if len(Version) == 0 {
@@ -425,12 +750,85 @@ func prepareRuntime(opts *CliOptions) error {
 	if err := NormalizeDTVia(); err != nil {
 		return err
 	}
+	if err := NormalizeHTTPVersion(); err != nil {
+		return err
+	}
+	if err := NormalizeDLTProto(); err != nil {
+		return err
+	}
+	if err := validateHTTP3(); err != nil {
+		return err
+	}
+	if err := NormalizePinSPKI(); err != nil {
+		return err
+	}
+	if err := NormalizeSNIMatrix(); err != nil {
+		return err
+	}
+	if err := PrepareRequestOptions(); err != nil {
+		return err
+	}
+	if err := PrepareDTExpectations(); err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(Config.TLSHelloSpecFile)) > 0 {
+		for _, hello := range []struct {
+			name string
+			set  bool
+		}{
+			{"--hello-firefox", opts.TLSHelloFirefox},
+			{"--hello-chrome", opts.TLSHelloChrome},
+			{"--hello-edge", opts.TLSHelloEdge},
+			{"--hello-safari", opts.TLSHelloSafari},
+		} {
+			if hello.set {
+				return fmt.Errorf("%q and %q cannot be provided at the same time", "--hello-spec", hello.name)
+			}
+		}
+	}
+	if len(Config.CompareFingerprints) > 0 {
+		set, err := ParseFingerprints(Config.CompareFingerprints)
+		if err != nil {
+			return err
+		}
+		if len(set) < 2 {
+			return fmt.Errorf("invalid value for %q: at least two fingerprints are needed for a comparison", "--compare-fingerprints")
+		}
+		if Config.HTTPVersion != "auto" && slices.ContainsFunc(set, func(fp TLSFingerprint) bool { return fp.ClientID == utls.HelloRandomized }) {
+			return fmt.Errorf("%q cannot force the ALPN of the randomized fingerprint in %q", "--http-version", "--compare-fingerprints")
+		}
+		Config.CompareFingerprintSet = set
+	}
+
+	if len(Config.InDBQuery) > 0 && len(Config.InDB) == 0 {
+		return fmt.Errorf("%q requires %q", "--in-db-query", "--in-db")
+	}
+	if err := NormalizeInputFormat(); err != nil {
+		return err
+	}
+	if err := NormalizeSampling(); err != nil {
+		return err
+	}
+	Config.ShardIndex, Config.ShardCount = 0, 0
+	if len(Config.Shard) > 0 {
+		index, count, err := ParseShard(Config.Shard)
+		if err != nil {
+			return err
+		}
+		Config.ShardIndex, Config.ShardCount = index, count
+	}
+	filter, err := ParseInputFilter(Config.InputFilter)
+	if err != nil {
+		return err
+	}
+	Config.InputFilterRules = filter
 
 	tMode, err := selectedIPMode(opts.IPv4Changed, opts.IPv6Changed)
 	if err != nil {
 		return err
 	}
 	trimConfigStrings()
+	Config.ResolveHostsDNS = opts.DNSChanged
 
 	if err := LoadSourceIPs(tMode, opts.IPv4Changed, opts.IPv6Changed); err != nil {
 		return err
@@ -469,9 +867,11 @@ func selectedIPMode(ipv4Changed, ipv6Changed bool) (int8, error) {
 
 func trimConfigStrings() {
 	Config.IPFile = strings.TrimSpace(Config.IPFile)
+	Config.InDB = strings.TrimSpace(Config.InDB)
 	Config.ResultFile = strings.TrimSpace(Config.ResultFile)
 	Config.SuffixLabel = strings.TrimSpace(Config.SuffixLabel)
 	Config.HostName = strings.TrimSpace(Config.HostName)
+	Config.SNI = strings.ToLower(strings.TrimSpace(Config.SNI))
 	Config.DTUrl = strings.TrimSpace(Config.DTUrl)
 	Config.DLTUrl = strings.TrimSpace(Config.DLTUrl)
 	Config.DBFile = strings.TrimSpace(Config.DBFile)
@@ -479,6 +879,9 @@ func trimConfigStrings() {
 }
 
 func validateURLs() error {
+	if len(Config.SNI) > 0 && !utils.IsValidDNSHost(Config.SNI) {
+		return fmt.Errorf("invalid value for %q: %q is not a hostname", "--sni", Config.SNI)
+	}
 	if !Config.DLTOnly && Config.DTHttps {
 		tURL, err := validateHTTPSURL(Config.DTUrl, "--dt-url")
 		if err != nil {
@@ -522,9 +925,13 @@ func prepareSourcePool() error {
 		return err
 	}
 	tQty := SrcIPs.Len()
+	streaming := SrcIPs.Streaming()
+	if streaming {
+		logger.Log.Infof("Streaming %q: %s candidates buffered, the rest is read as needed", Config.IPFile, utils.FormatHostCount(tQty))
+	}
 	if Config.TestAll {
 		Config.ResultMin = -1
-	} else {
+	} else if !streaming {
 		tResultMin := big.NewInt(int64(Config.ResultMin))
 		if tQty.Cmp(tResultMin) == -1 && !Config.Supplement {
 			Config.ResultMin = int(tQty.Int64())
@@ -1,38 +1,46 @@
 package config
 
 import (
-	"bufio"
+	"context"
 	"fmt"
+	"maps"
 	"math/big"
 	"math/rand"
 	"net"
-	"os"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"cftestor/internal/fetcher"
+	"cftestor/internal/logger"
 	"cftestor/internal/utils"
 	utls "github.com/refraction-networking/utls"
 )
 
 const (
-	WorkerStopSignal        = "0"
-	WorkOnGoing         int = 1
-	ControllerInterval      = 100               // in millisecond
-	StatisticIntervalT      = 1000              // in millisecond, valid in tcell mode
-	StatisticIntervalNT     = 10000             // in millisecond, valid in non-tcell mode
-	QuitWaitingTime         = 3                 // in second
-	DownloadBufferSize      = 1024 * 64         // in byte
-	FileDefaultSize         = 1024 * 1024 * 300 // in byte
-	DownloadSizeMin         = 1024 * 1024       // in byte
-	DefaultDLTUrl           = "https://speed.cloudflare.com/__down?bytes=99999999"
-	DefaultDTUrl            = "https://speed.cloudflare.com/__down?bytes=0"
-	UserAgentChrome         = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Safari/537.36"
-	UserAgentFirefox        = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:124.0) Gecko/20100101 Firefox/124.0"
-	UserAgentEdge           = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Safari/537.36"
-	UserAgentSafari         = "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.3.1 Safari/605.1.15"
+	WorkerStopSignal         = "0"
+	WorkOnGoing          int = 1
+	ControllerInterval       = 100               // in millisecond
+	StatisticIntervalT       = 1000              // in millisecond, valid in tcell mode
+	StatisticIntervalNT      = 10000             // in millisecond, valid in non-tcell mode
+	QuitWaitingTime          = 3                 // in second
+	DownloadBufferSize       = 1024 * 64         // in byte
+	FileDefaultSize          = 1024 * 1024 * 300 // in byte
+	DownloadSizeMin          = 1024 * 1024       // in byte
+	DTExpectBodyMax          = 1024 * 1024 * 4   // in byte, DT body read for --dt-expect-* checks
+	SourceStreamPrefetch     = 100000            // in line, plain-text input read before testing starts
+	DefaultDLTUrl            = "https://speed.cloudflare.com/__down?bytes=99999999"
+	DefaultDTUrl             = "https://speed.cloudflare.com/__down?bytes=0"
+	UserAgentChrome          = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Safari/537.36"
+	UserAgentFirefox         = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:124.0) Gecko/20100101 Firefox/124.0"
+	UserAgentEdge            = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Safari/537.36"
+	UserAgentSafari          = "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.3.1 Safari/605.1.15"
 
 	DefaultDBFile        = "ip.db"
 	DefaultTestHost      = "speed.cloudflare.com"
@@ -47,6 +55,44 @@ const (
 	DefaultPort     int  = 443
 )
 
+// result CSV column names, in the order WriteCSVResult writes them
+const (
+	CsvTestTime = "TestTime"
+	CsvIP       = "IP"
+	CsvDLS      = "DLSpeed(DLS,KB/s)"
+	CsvDA       = "DelayAvg(DA,ms)"
+	CsvDS       = "DelaySource(DS)"
+	CsvDTPR     = "DTPassedRate(DTPR,%)"
+	CsvDTC      = "DTCount(DTC)"
+	CsvDTPC     = "DTPassedCount(DTPC)"
+	CsvDMI      = "DelayMin(DMI,ms)"
+	CsvDMX      = "DelayMax(DMX,ms)"
+	CsvDLTC     = "DLTCount(DLTC)"
+	CsvDLTPC    = "DLTPassedCount(DLTPC)"
+	CsvDLPR     = "DLTPassedRate(DLPR,%)"
+	CsvCity     = "City(Src)"
+	CsvASN      = "ASN(Src)"
+	CsvLoc      = "Location(CF)"
+	CsvProto    = "Protocol(PROTO)"
+	CsvTLSV     = "TLSVersion(TLSV)"
+	CsvCipher   = "Cipher(CIPHER)"
+	CsvCSUB     = "CertSubject(CSUB)"
+	CsvCISS     = "CertIssuer(CISS)"
+	CsvCSAN     = "CertSANs(CSAN)"
+	CsvSPKI     = "SPKI-SHA256(SPKI)"
+	CsvChain    = "ChainSHA256(CHAIN)"
+	CsvCOUT     = "ChainOutlier(COUT)"
+	CsvHST      = "HTTPStatus(HST)"
+	CsvRay      = "CFRay(RAY)"
+	CsvFront    = "Fronting(FRONT)"
+	CsvPXA      = "ProxyLegAvg(PXA,ms)"
+	CsvEGA      = "EdgeLegAvg(EGA,ms)"
+	CsvSRC      = "SourceIPs(SRC)"
+	CsvOrig     = "Origin(ORIG)"
+	CsvSeed     = "Seed(SEED)"
+	CsvFail     = "FailReason(FAIL)"
+)
+
 var (
 	CFIPV4 = []string{
 		"103.21.244.0/24",
@@ -184,22 +230,40 @@ var (
 	}
 	UTF8BomBytes    = []byte{0xEF, 0xBB, 0xBF}
 	ResultCsvHeader = []string{
-		"TestTime",
-		"IP",
-		"DLSpeed(DLS,KB/s)",
-		"DelayAvg(DA,ms)",
-		"DelaySource(DS)",
-		"DTPassedRate(DTPR,%)",
-		"DTCount(DTC)",
-		"DTPassedCount(DTPC)",
-		"DelayMin(DMI,ms)",
-		"DelayMax(DMX,ms)",
-		"DLTCount(DLTC)",
-		"DLTPassedCount(DLTPC)",
-		"DLTPassedRate(DLPR,%)",
-		"City(Src)",
-		"ASN(Src)",
-		"Location(CF)",
+		CsvTestTime,
+		CsvIP,
+		CsvDLS,
+		CsvDA,
+		CsvDS,
+		CsvDTPR,
+		CsvDTC,
+		CsvDTPC,
+		CsvDMI,
+		CsvDMX,
+		CsvDLTC,
+		CsvDLTPC,
+		CsvDLPR,
+		CsvCity,
+		CsvASN,
+		CsvLoc,
+		CsvProto,
+		CsvTLSV,
+		CsvCipher,
+		CsvCSUB,
+		CsvCISS,
+		CsvCSAN,
+		CsvSPKI,
+		CsvChain,
+		CsvCOUT,
+		CsvHST,
+		CsvRay,
+		CsvFront,
+		CsvPXA,
+		CsvEGA,
+		CsvSRC,
+		CsvOrig,
+		CsvSeed,
+		CsvFail,
 	}
 	BaseCfCDNCgiTraceUrl = "https://speed.cloudflare.com/cdn-cgi/trace"
 	SourceLevelUser      = 0
@@ -208,7 +272,7 @@ var (
 )
 
 var (
-	MaxHostLenBig                            = big.NewInt(MaxHostLen)
+	MaxHostLenBig                                  = big.NewInt(MaxHostLen)
 	Version, BuildTag, BuildDate, BuildHash string = "dev", "dev", "dev", "dev"
 	IPStr                                   []string
 	VerifyResultsMap                               = make(map[string]VerifyResults)
@@ -246,6 +310,10 @@ type AppConfig struct {
 	DTHttps                     bool
 	DisableDownload             bool
 	DTVia                       string
+	HTTPVersion                 string
+	DTHTTP3                     bool
+	DLTProto                    string
+	DLTHTTP3                    bool
 	DTHttpRspReturnCodeExpected int
 	EnableDTEvaluation          bool
 	IPv4Mode                    bool
@@ -253,6 +321,25 @@ type AppConfig struct {
 	DTOnly                      bool
 	DLTOnly                     bool
 	TLSClientID                 utls.ClientHelloID
+	TLSHelloSpecFile            string
+	CompareFingerprints         []string
+	CompareFingerprintSet       []TLSFingerprint
+	PinSPKI                     []string
+	SNIMatrix                   []string
+	SNI                         string
+	Headers                     []string
+	DTMethod                    string
+	DTBody                      string
+	DTBodyFile                  string
+	RequestHeaders              http.Header
+	RequestBody                 []byte
+	DTExpectBody                string
+	DTExpectBodyRe              *regexp.Regexp
+	DTExpectHeaders             []string
+	DTExpectSHA256              string
+	Proxy                       string
+	ProxyURL                    *url.URL
+	ExpectIssuer                string
 	UserAgent                   string
 	StoreToFile                 bool
 	StoreToDB                   bool
@@ -279,6 +366,22 @@ type AppConfig struct {
 	OutboundInterfaceIndex      int
 	OutboundSourceIP            net.IP
 	OutboundSourceZone          string
+	ViaInterfaces               []string
+	ResolveHostsDNS             bool
+	ExpandHosts                 bool
+	InputFilter                 string
+	InputFilterRules            InputFilter
+	InDB                        string
+	InDBQuery                   string
+	InFormat                    string
+	Sampling                    string
+	StratifyK                   int
+	Seed                        int64
+	Shard                       string
+	ShardIndex                  int
+	ShardCount                  int
+	SourceIPs                   []string
+	ViaMarks                    []string
 	FetchIPv6File               string
 	FetchIPv4File               string
 	FetchCFDomainsFile          string
@@ -292,39 +395,107 @@ var Help = AppArt + `
   Find and verify the best Cloudflare CDN edge nodes for your network.
   https://github.com/zhfreal/cftestor
 
-Usage: cftestor [options]
+Usage: cftestor [scan] [options]
+       cftestor <command> [options]
+
+Commands:
+    scan                          Find and verify the best edge nodes with the options below (the default).
+    fetch ipv4|ipv6|domains       Fetch active Cloudflare IPv4/IPv6 CIDRs or CDN domains.
+    history                       Show earlier results stored in a SQLite file.
+    export                        Export earlier results from a SQLite file as CSV or JSON.
+    serve                         Serve earlier results from a SQLite file over HTTP as JSON.
+    inspect                       Show the candidates a scan with these options would test, without testing.
+    merge FILE...                 Combine the CSV or SQLite results of several runs into one ranking.
+    config dump                   Print the settings merged from --config, env and flags.
+    help [command]                Show help for a command; "cftestor <command> -h" works too.
 
 Core Options:
-    -s, --ip           strings    Specify IP, CIDR, or host:port. Examples: "-s 1.0.0.1", "-s 1.0.0.1/24",
-                                  "-s 1.1.1.1:2053", "-s example.com:443". Can be provided multiple times.
-    -i, --in           string     Path to a file containing IPs, CIDRs, or host:port entries (one per line).
+    -s, --ip           strings    Specify IP, CIDR, range, or host:port. Examples: "-s 1.0.0.1", "-s 1.0.0.1/24",
+                                  "-s 1.1.1.1:2053", "-s example.com:443", "-s 1.2.3.10-1.2.3.200".
+                                  "CIDR:ports" (e.g. "104.16.0.0/13:443,2053") uses its own ports instead of -p;
+                                  "!CIDR" excludes addresses from all input. Can be provided multiple times.
+    -i, --in           string     Path to a file with one -s style entry per line (IPs, CIDRs, ranges,
+                                  "CIDR:ports", "!CIDR" exclusions, host:port; "#" starts a comment), or "-"
+                                  for stdin. gzip and zstd input is decompressed. Large lists are streamed.
+                                  A result CSV written by --out-file is detected and its IP column is read.
+                                  Exclusions in a streamed stdin only drop candidates read after them; pass
+                                  them with -s instead.
+        --in-format    string     Format of --in: auto, plain, csv (result CSV), masscan-json, masscan-list,
+                                  nmap-xml (open ports only), or zmap (CSV). Default: auto (detected).
+        --input-filter string     Filter result CSV and --in-db input by speed, delay, and colo, e.g.
+                                  "dls>=1000,da<200,colo=HKG|NRT". Fields: dls, da, colo. Ops: >= <= > < = !=.
+        --in-db        string     Read candidates from the CFTD table of a SQLite results file.
+        --in-db-query  string     SQL WHERE clause for --in-db rows, e.g. "LABEL = 'home' AND DLS > 5000".
     -p, --port         strings    Specify port(s) to test. Supports single ports, ranges, and lists (e.g.,
                                   "443", "80-443", "443,8443"). Default: 443.
     -a, --test-all                Test all provided IPs until none remain. Default: off.
+        --sampling     string     How random draws pick ranges: uniform (each range alike), weighted (by range
+                                  size), or stratified (--stratify-k picks per /24 or IPv6 /48 before any block
+                                  is revisited). Ignored with --test-all. Default: uniform.
+        --stratify-k   int        Picks per block for --sampling stratified. Default: 1.
+        --seed         int        Seed for every random choice (range picks, shuffles, IPv4/IPv6 interleaving),
+                                  so the same command samples the same candidates. Default: time-based; the
+                                  seed in use is logged and stored with the results.
+        --shard        string     Test only shard i of n ("i/n", e.g. "2/3") of the candidates, so n machines
+                                  cover disjoint parts of the same input. Combine outputs with "cftestor merge".
+                                  Other shards' candidates are drawn and skipped, so source counts and progress
+                                  cover the whole input, and -r applies to each machine.
     -r, --result       int        Target number of final qualified results. Default: 10.
         --fast                    Use a limited set of internal Cloudflare IPs for quick scanning.
     -4, --ipv4                    Test IPv4 only. Default: on (if no IPs specified).
     -6, --ipv6                    Test IPv6 only. Default: off. DNS hosts are resolved by the dialer.
-        --fetch-ipv4   string     Fetch active Cloudflare IPv4 CIDRs dynamically, save to file, and exit.
-        --fetch-ipv6   string     Fetch active Cloudflare IPv6 CIDRs dynamically, save to file, and exit.
-        --fetch-cf-domains string Fetch, verify, and save top domains using Cloudflare CDN to a file, and exit.
-        --dns          string     Custom DNS server for dynamic fetching.
+        --fetch-ipv4   string     Deprecated, use "cftestor fetch ipv4 -o FILE" instead.
+        --fetch-ipv6   string     Deprecated, use "cftestor fetch ipv6 -o FILE" instead.
+        --fetch-cf-domains string Deprecated, use "cftestor fetch domains -o FILE" instead.
+        --dns          string     Custom DNS server for dynamic fetching. When given, host:port candidates are also
+                                  resolved through it at scan time and reported per IP with the hostname kept.
+        --expand-hosts            Queue every A/AAAA address of each host:port candidate (filtered by -4/-6) as its
+                                  own candidate, annotated with the hostnames behind it. Default: off.
     -C, --no-cache                Bypass CDN/Proxy caching for custom URLs (ignored for defaults).
 
 Network Options:
         --mark        string      Set Linux socket fwmark for outbound packets. Supports decimal and hex.
         --xmark       string      Alias for --mark.
         --interface   string      Bind outbound packets to an interface name, interface index, or local source IP.
+        --source-ips   strings    Spread outbound connections round-robin across local source IPs. An interface name
+                                  adds all of its non-link-local addresses. The source used is recorded per result.
+        --via-interfaces strings  Compare outbound paths: run DT for every candidate over every listed interface name,
+                                  index, or source IP, then DLT over each IP's best path.
+        --via-marks    strings    Compare outbound paths by socket mark (Linux). Combined with --via-interfaces, each
+                                  interface and each mark is one path. Prints a per-path table, a ranking per path,
+                                  and the best path per IP.
+        --proxy        string     Send every DT, DLT, and trace connection through socks5://[user:pass@]host:port or
+                                  http://[user:pass@]host:port (CONNECT). Results record the proxy and edge legs separately.
 
 Delay Test (DT) Options:
     -m, --dt-thread    int        Number of concurrent DT workers. Default: 20.
     -t, --dt-timeout   int        Timeout for a single DT attempt in ms. Default: 2000 (TLS/SSL) or 5000 (HTTPS).
     -c, --dt-count     int        Number of DT attempts per candidate. Default: 4.
-        --dt-via       string     DT protocol: "https", "tls", or "ssl". Default: https.
+        --sni          string     TLS SNI for HTTPS DT/DLT, sent independently of the Host header taken from --dt-url /
+                                  --dlt-url. Results record the status code, cf-ray presence, and whether the edge
+                                  honoured the pairing.
+        --sni-matrix   strings    Diagnose SNI filtering instead of scanning: handshake with every listed SNI ("-" for no
+                                  SNI) against up to --result candidates (all with --test-all) and classify each one as
+                                  healthy, SNI-level block, or IP-level block. Certificates are not verified in this mode.
+        --dt-via       string     DT protocol: "https", "h3" (HTTP/3 over QUIC), "tls", or "ssl". Default: https.
         --dt-via-https            Deprecated alias for --dt-via https.
         --dt-url       string     URL to use for HTTPS-based DT. Default: ` + DefaultDTUrl + `
+    -H, --header       string     Extra 'Name: value' header for DT/DLT requests; overrides the defaults, and 'Host: ...'
+                                  sets the Host header. Can be provided multiple times.
+        --dt-method    string     HTTP method for DT/DLT requests. Default: GET.
+        --dt-body      string     Request body for DT/DLT requests.
+        --dt-body-file string     Read the DT/DLT request body from a file.
         --hostname     string     SNI hostname for TLS/SSL DT. Default: ` + DefaultTestHost + `
+        --http-version string     Force the ALPN offered by HTTPS probes over TCP: "auto", "1.1", or "2".
+                                  Default: auto.
         --dt-expect-code int      Expected HTTP status code for DT. Default: 200.
+        --dt-expect-body string   Fail DT unless the response body matches this regular expression.
+        --dt-expect-header string Fail DT unless the response has this header ('Name' or 'Name: substring'). Can be
+                                  provided multiple times, e.g. --dt-expect-header cf-ray.
+        --dt-expect-sha256 string Fail DT unless the response body has this SHA-256 (hex). Body checks read at most 4 MiB.
+        --pin-spki     strings    Fail DT unless the leaf certificate's SPKI SHA-256 matches one of these pins
+                                  ("sha256/<base64>", base64, or hex). Can be provided multiple times.
+        --expect-issuer string    Fail DT unless the leaf certificate issuer contains this text, e.g. "Cloudflare".
         --ev-dt                   Enable DT evaluation using all attempts. Default: off.
     -k, --ev-dt-delay  int        Maximum allowed average DT delay in ms. Default: 600.
         --ev-dt-dtpr   float      Minimum required DT pass rate (percentage). Default: 100.0.
@@ -335,6 +506,8 @@ Download Test (DLT) Options:
     -d, --dlt-period   int        Maximum duration for one DLT attempt in seconds. Default: 10.
     -b, --dlt-count    int        Number of DLT attempts per candidate. Default: 1.
     -u, --dlt-url      string     URL to use for DLT. Default: ` + DefaultDLTUrl + `
+        --dlt-proto    string     DLT transport: "tcp" (h2 or http/1.1 over uTLS) or "h3" (HTTP/3 over QUIC).
+                                  Default: tcp.
         --dlt-timeout  int        HTTP response timeout for DLT in ms. Default: 5000.
     -l, --speed        float      Minimum required download speed in KB/s. Default: 6000.
     -I, --interval     int        Interval between test attempts in ms. Default: 500.
@@ -354,6 +527,12 @@ Fingerprinting Options:
         --hello-chrome            Simulate Chrome TLS fingerprint (Default).
         --hello-edge              Simulate Edge TLS fingerprint.
         --hello-safari            Simulate Safari TLS fingerprint.
+        --hello-spec   string     Load a ClientHello from a file (JSON ClientHelloSpec or captured hex dump) and use it
+                                  for DT, DLT, and trace requests. Cannot be combined with the --hello-* flags.
+        --compare-fingerprints strings
+                                  After the scan, rerun DT/DLT on every qualified IP once per fingerprint and print a
+                                  delay/speed matrix. Values: chrome, firefox, edge, safari, randomized, custom
+                                  (needs --hello-spec). Example: --compare-fingerprints chrome,firefox,safari,randomized
 
 Output & Storage Options:
     -w, --to-file                 Save results to a CSV file.
@@ -393,12 +572,36 @@ Alias Options:
         --quiet                   Alias for --silence.
 
 General Options:
+        --config       string     Read settings from a JSON, TOML, or YAML file. Keys are long flag names
+                                  ("dt-only = true", "ip = ['1.0.0.0/24']"); tables are named profiles.
+        --profile      string     Apply this profile of --config on top of its top-level settings.
+                                  Any flag can also be set as CFTESTOR_<FLAG> (e.g. CFTESTOR_DT_ONLY=true).
+                                  Precedence: flags > env > profile > rest of --config > defaults.
     -S, --silence                 Enable silence mode with minimal output.
     -V, --debug                   Print detailed debug logs.
     -v, --version                 Show version information and exit.
     -h, --help                    Show this help message.
 `
 
+// TLSFingerprint is one entry of --compare-fingerprints. An empty UserAgent
+// keeps the configured one.
+type TLSFingerprint struct {
+	Name      string
+	ClientID  utls.ClientHelloID
+	UserAgent string
+}
+
+// CertInfo describes the TLS session and leaf certificate seen by a probe.
+type CertInfo struct {
+	TLSVersion  string
+	Cipher      string
+	Subject     string
+	Issuer      string
+	SANs        []string
+	SPKISHA256  string
+	ChainSHA256 string
+}
+
 type SingleResult struct {
 	DTPassed      bool
 	DTDuration    time.Duration
@@ -407,6 +610,18 @@ type SingleResult struct {
 	DLTPassed     bool
 	DLTDuration   time.Duration
 	DLTDataSize   int64
+	Proto         string
+	Cert          CertInfo
+	StatusCode    int
+	CFRay         bool
+	FailReason    string
+	ProxyDuration time.Duration
+	// EdgeDuration is the time --proxy took to connect on to the edge
+	EdgeDuration time.Duration
+	SourceAddr   string
+	// Transport is "tcp" or "quic". DTDuration is its handshake and, for
+	// HTTPS probes, HttpReqRspDur the time to the first response byte after it
+	Transport string
 }
 
 type SingleVerifyResult struct {
@@ -417,24 +632,53 @@ type SingleVerifyResult struct {
 }
 
 type VerifyResults struct {
-	TestTime time.Time
-	IP       *string
-	Loc      *string
-	Dtc      int
-	Dtpc     int
-	Dtpr     float64
-	Da       float64
-	DaVar    float64
-	DaStd    float64
-	Dmi      float64
-	Dmx      float64
-	Dltc     int
-	Dltpc    int
-	Dltpr    float64
-	Dls      float64
-	Dlds     int64
-	Dltd     float64
-	DtDList  []float64
+	TestTime   time.Time
+	IP         *string
+	Loc        *string
+	Proto      string
+	Cert       CertInfo
+	StatusCode int
+	CFRay      bool
+	// FailReason is the reason of the latest failed attempt, if any. Combine
+	// keeps the receiver's, which is the DLT one when DT and DLT are joined.
+	FailReason string
+	// ProxyAvg is the average time in ms spent reaching --proxy, and EdgeAvg
+	// the average time the proxy took to connect on to the edge
+	ProxyAvg float64
+	EdgeAvg  float64
+	// HandshakeAvg and TTFBAvg split Da of HTTPS probes into the TCP+TLS or
+	// QUIC handshake and the time to first byte, in ms
+	HandshakeAvg float64
+	TTFBAvg      float64
+	// Origin is the hostname the IP was resolved from, for host candidates
+	Origin string
+	// SourceAddrs are the --source-ips addresses the attempts were dialed from
+	SourceAddrs []string
+	// CertOutlier is set when the certificate chain differs from the one most
+	// other results presented, a sign of interception.
+	CertOutlier bool
+	Dtc         int
+	Dtpc        int
+	Dtpr        float64
+	Da          float64
+	DaVar       float64
+	DaStd       float64
+	Dmi         float64
+	Dmx         float64
+	Dltc        int
+	Dltpc       int
+	Dltpr       float64
+	Dls         float64
+	Dlds        int64
+	Dltd        float64
+	DtDList     []float64
+}
+
+// AddSourceAddr records a source address once.
+func (a *VerifyResults) AddSourceAddr(addr string) {
+	if len(addr) > 0 && !slices.Contains(a.SourceAddrs, addr) {
+		a.SourceAddrs = append(a.SourceAddrs, addr)
+	}
 }
 
 func (a *VerifyResults) Combine(b VerifyResults) {
@@ -447,6 +691,27 @@ func (a *VerifyResults) Combine(b VerifyResults) {
 	if b.Loc != nil && len(*b.Loc) != 0 && (a.Loc == nil || len(*a.Loc) == 0) {
 		a.Loc = b.Loc
 	}
+	if len(b.Proto) != 0 && len(a.Proto) == 0 {
+		a.Proto = b.Proto
+	}
+	if len(b.Cert.ChainSHA256) != 0 && len(a.Cert.ChainSHA256) == 0 {
+		a.Cert = b.Cert
+	}
+	if b.StatusCode != 0 && a.StatusCode == 0 {
+		a.StatusCode, a.CFRay = b.StatusCode, b.CFRay
+	}
+	if len(b.FailReason) != 0 && len(a.FailReason) == 0 {
+		a.FailReason = b.FailReason
+	}
+	if len(b.Origin) != 0 && len(a.Origin) == 0 {
+		a.Origin = b.Origin
+	}
+	if b.ProxyAvg > 0 && a.ProxyAvg == 0 {
+		a.ProxyAvg, a.EdgeAvg = b.ProxyAvg, b.EdgeAvg
+	}
+	for _, addr := range b.SourceAddrs {
+		a.AddSourceAddr(addr)
+	}
 	a.Dtc += b.Dtc
 	a.Dtpc += b.Dtpc
 	if a.Dtc > 0 {
@@ -474,6 +739,9 @@ func (a *VerifyResults) Combine(b VerifyResults) {
 	if a.Dmx < b.Dmx && b.Dtpc > 0 {
 		a.Dmx = b.Dmx
 	}
+	if b.HandshakeAvg > 0 && a.HandshakeAvg == 0 {
+		a.HandshakeAvg, a.TTFBAvg = b.HandshakeAvg, b.TTFBAvg
+	}
 	a.Dltc += b.Dltc
 	a.Dltpc += b.Dltpc
 	if a.Dltc > 0 {
@@ -486,6 +754,51 @@ func (a *VerifyResults) Combine(b VerifyResults) {
 	}
 }
 
+// Fronting reports whether the edge honoured a --sni / Host pairing: the
+// expected status came back with a cf-ray header. It is empty without --sni.
+func (a *VerifyResults) Fronting() string {
+	if len(Config.SNI) == 0 || a.StatusCode == 0 {
+		return ""
+	}
+	if a.CFRay && (a.StatusCode == Config.DTHttpRspReturnCodeExpected || a.StatusCode == 200) {
+		return "honoured"
+	}
+	return "refused"
+}
+
+// MarkCertOutliers flags results whose certificate chain differs from the
+// chain most results presented. Nothing is flagged without a clear majority.
+func MarkCertOutliers(v []VerifyResults) int {
+	counts := make(map[string]int)
+	for _, r := range v {
+		if len(r.Cert.ChainSHA256) > 0 {
+			counts[r.Cert.ChainSHA256]++
+		}
+	}
+	if len(counts) < 2 {
+		return 0
+	}
+	majority, best, tie := "", 0, false
+	for chain, n := range counts {
+		if n > best {
+			majority, best, tie = chain, n, false
+		} else if n == best {
+			tie = true
+		}
+	}
+	if tie {
+		return 0
+	}
+	marked := 0
+	for i := range v {
+		if len(v[i].Cert.ChainSHA256) > 0 && v[i].Cert.ChainSHA256 != majority {
+			v[i].CertOutlier = true
+			marked++
+		}
+	}
+	return marked
+}
+
 type ResultSpeedSorter []VerifyResults
 
 func (a ResultSpeedSorter) Len() int           { return len(a) }
@@ -504,7 +817,7 @@ type OverAllStat struct {
 }
 
 type SafeLooper struct {
-	mu sync.Mutex
+	mu       sync.Mutex
 	t, c     int
 	interval int
 }
@@ -620,12 +933,20 @@ func NewSafeLooperWithInterval(t, interv int) *SafeLooper {
 }
 
 type SourceIPs struct {
-	mu               sync.Mutex
-	srcHosts         []*string
-	srcIPRsRaw       []*utils.IPRange
-	srcIPRsExtracted []net.IP
-	Ports            []int
-	tRnd             *rand.Rand
+	mu            sync.Mutex
+	srcHosts      []*string
+	resolved      []*string
+	resolvedSeen  map[string]bool
+	srcIPRsRaw    []*utils.IPRange
+	srcIPs4       addrPool
+	srcIPs6       addrPool
+	srcPortRanges []*portRange
+	excludes      []*utils.IPRange
+	excludeSeen   map[string]bool
+	strata        map[*utils.IPRange]*stratum
+	Ports         []int
+	tRnd          *rand.Rand
+	stream        *hostStream
 }
 
 func (s *SourceIPs) TotalHosts() *big.Int {
@@ -635,12 +956,15 @@ func (s *SourceIPs) TotalHosts() *big.Int {
 	for i := 0; i < len(s.srcIPRsRaw); i++ {
 		t_qty = t_qty.Add(t_qty, s.srcIPRsRaw[i].Length())
 	}
-	t_qty = t_qty.Add(t_qty, big.NewInt(int64(len(s.srcIPRsExtracted))))
+	t_qty = t_qty.Add(t_qty, big.NewInt(int64(s.srcIPs4.len()+s.srcIPs6.len())))
 	portCount := int64(len(s.Ports))
 	if portCount > 1 {
 		t_qty = t_qty.Mul(t_qty, big.NewInt(portCount))
 	}
-	t_qty = t_qty.Add(t_qty, big.NewInt(int64(len(s.srcHosts))))
+	t_qty = t_qty.Add(t_qty, big.NewInt(int64(len(s.srcHosts)+len(s.resolved))))
+	for _, pr := range s.srcPortRanges {
+		t_qty = t_qty.Add(t_qty, new(big.Int).Mul(pr.ipr.Length(), big.NewInt(int64(len(pr.ports)))))
+	}
 	return t_qty
 }
 
@@ -653,21 +977,56 @@ func (s *SourceIPs) LenInt() int {
 	defer s.mu.Unlock()
 	t_qty := 0
 	t_qty += len(s.srcIPRsRaw)
-	t_qty += len(s.srcIPRsExtracted)
-	t_qty += len(s.srcHosts)
+	t_qty += s.srcIPs4.len() + s.srcIPs6.len()
+	t_qty += len(s.srcHosts) + len(s.resolved)
+	t_qty += len(s.srcPortRanges)
 	return t_qty
 }
 
 func (s *SourceIPs) IsEmpty() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return len(s.srcIPRsRaw) == 0 && len(s.srcIPRsExtracted) == 0 && len(s.srcHosts) == 0
+	return s.isEmpty()
+}
+
+func (s *SourceIPs) isEmpty() bool {
+	return len(s.srcIPRsRaw) == 0 && s.srcIPs4.len() == 0 && s.srcIPs6.len() == 0 && len(s.srcHosts) == 0 && len(s.resolved) == 0 && len(s.srcPortRanges) == 0 && s.stream == nil
 }
 
 func (s *SourceIPs) add(IPs string, mode int8) error {
 	ips := strings.TrimSpace(IPs)
-	ips = strings.Split(ips, "#")[0]
-	if utils.IsValidIPs(ips) {
+	ips = strings.TrimSpace(strings.Split(ips, "#")[0])
+	if len(ips) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(ips, "!") {
+		return s.addExclusion(strings.TrimSpace(ips[1:]))
+	}
+	if block, portStr, ok := splitEntryPorts(ips); ok {
+		// a single ip:port stays a plain host candidate below
+		_, singlePortErr := strconv.Atoi(portStr)
+		if ipr := parseIPBlock(block); ipr != nil && (!utils.IsValidIP(block) || singlePortErr != nil) {
+			ports, err := parsePorts(portStr)
+			if err != nil {
+				return err
+			}
+			if len(ports) == 0 {
+				return fmt.Errorf("the input %q has no ports", ips)
+			}
+			s.addWithPorts(ipr, ports, mode)
+			return nil
+		}
+	}
+	if ipr := parseIPRange(ips); ipr != nil {
+		if tV := iprVer(ipr); (tV & mode) != tV {
+			return nil
+		}
+		if ipr.Length().Cmp(MaxHostLenBig) < 1 && !keepRangesRaw() {
+			s.pushExtracted(ipr)
+		} else {
+			s.srcIPRsRaw = append(s.srcIPRsRaw, ipr)
+		}
+	} else if utils.IsValidIPs(ips) {
 		tV := utils.GetIPsVer(ips)
 		if tV == TypeIPErr {
 			return fmt.Errorf("\"%v\" is invalid", ips)
@@ -679,8 +1038,8 @@ func (s *SourceIPs) add(IPs string, mode int8) error {
 		if ipr == nil {
 			return fmt.Errorf("\"%v\" is invalid", ips)
 		}
-		if ipr.Len.Cmp(MaxHostLenBig) < 1 {
-			s.srcIPRsExtracted = append(s.srcIPRsExtracted, ipr.ExtractAll(MaxHostLen)...)
+		if ipr.Length().Cmp(MaxHostLenBig) < 1 && !keepRangesRaw() {
+			s.pushExtracted(ipr)
 		} else {
 			s.srcIPRsRaw = append(s.srcIPRsRaw, ipr)
 		}
@@ -695,7 +1054,7 @@ func (s *SourceIPs) add(IPs string, mode int8) error {
 		}
 		s.srcHosts = append(s.srcHosts, &ips)
 	} else {
-		return fmt.Errorf("the input %q is not a valid IP, CIDR, or host:port", ips)
+		return fmt.Errorf("the input %q is not a valid IP, CIDR, range, or host:port", ips)
 	}
 	return nil
 }
@@ -709,7 +1068,7 @@ func (s *SourceIPs) Add(IPs string, mode int8) error {
 func (s *SourceIPs) AddFromSlice(ipsSlice []string, mode int8) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, ips := range ipsSlice {
+	for _, ips := range mergePortFragments(ipsSlice) {
 		err := s.add(ips, mode)
 		if err != nil {
 			return err
@@ -719,73 +1078,68 @@ func (s *SourceIPs) AddFromSlice(ipsSlice []string, mode int8) error {
 }
 
 func (s *SourceIPs) AddFromFile(filename string, mode int8) error {
+	want, err := s.addFromFile(filename, mode)
+	if err != nil || want == 0 {
+		return err
+	}
+	// small inputs are read completely here; larger ones are streamed
+	// by RetrieveSome as candidates are needed
+	if err := s.fill(want); err != nil {
+		s.mu.Lock()
+		s.closeStream()
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// addFromFile reads filename, or starts streaming it. want is then how many
+// candidates to read before returning, and 0 when the input was read whole.
+func (s *SourceIPs) addFromFile(filename string, mode int8) (want int, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	tFile, err := os.Open(filename)
+	if s.stream != nil {
+		return 0, fmt.Errorf("cannot read %q while %q is still being streamed", filename, s.stream.name)
+	}
+	reader, closer, err := openInput(filename)
 	if err != nil {
-		return fmt.Errorf("file %q is not accessible: %w", filename, err)
-	}
-	defer tFile.Close()
-	scanner := bufio.NewScanner(tFile)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		tIp := strings.TrimSpace(scanner.Text())
-		if len(tIp) == 0 {
-			continue
-		}
-		err := s.add(tIp, mode)
+		return 0, err
+	}
+	format := detectInputFormat(reader)
+	if Config.InFormat != "" && Config.InFormat != InputFormatAuto {
+		format = Config.InFormat
+	}
+	switch format {
+	case InputFormatResultCSV:
+		defer closer.Close()
+		records, err := readResultCSV(reader)
 		if err != nil {
-			return err
+			return 0, fmt.Errorf("error reading result CSV %q: %w", filename, err)
 		}
+		return 0, s.addRecords(records, mode)
 	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading file %q: %w", filename, err)
+	if len(Config.InputFilterRules) > 0 {
+		logger.Log.Warningf("%q only applies to result CSV and %q input; ignored for %q", "--input-filter", "--in-db", filename)
 	}
-	return nil
+	if format == InputFormatPlain && filename != "-" {
+		if err := s.loadExclusions(filename); err != nil {
+			closer.Close()
+			return 0, err
+		}
+	}
+	s.stream = newHostStream(filename, mode, reader, closer, itemReaderFor(format))
+	return s.bufferedLen() + SourceStreamPrefetch, nil
 }
 
 func (s *SourceIPs) AddPorts(srcPorts []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	portRegex := regexp.MustCompile(`[,;|]+`)
-	portRangeRegex := regexp.MustCompile(`^\d+[-:]\d+$`)
-	portRangeSplitRegex := regexp.MustCompile(`[-:]`)
-	if len(srcPorts) > 0 {
-		for _, portStr := range srcPorts {
-			portStrSlice := portRegex.Split(portStr, -1)
-			for _, portValue := range portStrSlice {
-				portValue = strings.TrimSpace(portValue)
-				if len(portValue) == 0 {
-					continue
-				}
-				if portRangeRegex.MatchString(portValue) {
-					portList := portRangeSplitRegex.Split(portValue, -1)
-					if len(portList) != 2 {
-						return invalidPortFlagError(portValue)
-					}
-					startPort, err := strconv.Atoi(portList[0])
-					if err != nil {
-						return invalidPortFlagError(portList[0])
-					}
-					endPort, err := strconv.Atoi(portList[1])
-					if err != nil {
-						return invalidPortFlagError(portList[1])
-					}
-					if startPort > endPort || startPort < 1 || endPort > 65535 {
-						return invalidPortFlagError(portValue)
-					}
-					for i := startPort; i <= endPort; i++ {
-						s.Ports = append(s.Ports, i)
-					}
-				} else {
-					port, err := strconv.Atoi(portValue)
-					if err != nil || port < 1 || port > 65535 {
-						return invalidPortFlagError(portValue)
-					}
-					s.Ports = append(s.Ports, port)
-				}
-			}
+	for _, portStr := range srcPorts {
+		ports, err := parsePorts(portStr)
+		if err != nil {
+			return err
 		}
+		s.Ports = append(s.Ports, ports...)
 	}
 	if len(s.Ports) == 0 {
 		s.Ports = append(s.Ports, DefaultPort)
@@ -799,15 +1153,33 @@ func invalidPortFlagError(value string) error {
 }
 
 func (s *SourceIPs) RetrieveSome(amount int, isRand bool) (targetIPs []*string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	numHosts := len(s.srcHosts)
-	if numHosts > 0 {
-		takeHosts := utils.MinInt(amount, numHosts)
-		targetIPs = append(targetIPs, s.srcHosts[:takeHosts]...)
-		s.srcHosts = s.srcHosts[takeHosts:]
+	// keep going while a whole batch is filtered out or fails to resolve, so
+	// that an empty result still means the input is exhausted
+	for {
+		s.fillLenient(amount)
+		s.mu.Lock()
+		hosts := s.retrieveHosts(amount - len(s.resolved))
+		s.mu.Unlock()
+
+		// resolving can take seconds, so it runs without holding the pool
+		candidates := resolveHostCandidates(hosts)
+
+		s.mu.Lock()
+		batch := s.queueHostCandidates(candidates, amount)
+		batch = append(batch, s.retrieveAddrs(amount-len(batch), isRand)...)
+		targetIPs = s.dropFiltered(batch)
+		exhausted := s.isEmpty() || (len(batch) == 0 && len(hosts) == 0)
+		s.mu.Unlock()
+		if len(targetIPs) > 0 || exhausted {
+			return
+		}
 	}
+}
+
+// retrieveAddrs takes up to amount candidates from the address and range
+// sources; hostnames are taken separately by retrieveHosts.
+func (s *SourceIPs) retrieveAddrs(amount int, isRand bool) (targetIPs []*string) {
+	targetIPs = append(targetIPs, s.retrievePortRanges(amount, isRand)...)
 
 	left := amount - len(targetIPs)
 	if left > 0 {
@@ -824,6 +1196,118 @@ func (s *SourceIPs) RetrieveSome(amount int, isRand bool) (targetIPs []*string)
 	return
 }
 
+// hostOrigins maps a resolved candidate such as 104.16.1.1:443 back to the
+// hostnames it was resolved from.
+var (
+	hostOriginsMu sync.RWMutex
+	hostOrigins   = make(map[string][]string)
+)
+
+// HostOrigin returns the hostnames a candidate was resolved from, joined by
+// ";", if any.
+func HostOrigin(host string) string {
+	hostOriginsMu.RLock()
+	defer hostOriginsMu.RUnlock()
+	return strings.Join(hostOrigins[host], ";")
+}
+
+func addHostOrigin(host, name string) {
+	hostOriginsMu.Lock()
+	defer hostOriginsMu.Unlock()
+	if !slices.Contains(hostOrigins[host], name) {
+		hostOrigins[host] = append(hostOrigins[host], name)
+	}
+}
+
+func resetHostOrigins() {
+	hostOriginsMu.Lock()
+	defer hostOriginsMu.Unlock()
+	clear(hostOrigins)
+}
+
+// hostCandidate is a candidate returned by resolveHostCandidates. origin is
+// the hostname it was resolved from, or "" when it was passed through as is.
+type hostCandidate struct {
+	target *string
+	origin string
+}
+
+// resolveHostCandidates resolves hostname candidates through --dns when it was
+// given explicitly, or through the system resolver for --expand-hosts.
+// Otherwise they are left to the dialer. Without --expand-hosts only the first
+// address is kept.
+func resolveHostCandidates(hosts []*string) (targets []hostCandidate) {
+	for _, h := range hosts {
+		if !Config.ResolveHostsDNS && !Config.ExpandHosts {
+			targets = append(targets, hostCandidate{target: h})
+			continue
+		}
+		name, port, err := net.SplitHostPort(*h)
+		if err != nil || net.ParseIP(name) != nil {
+			targets = append(targets, hostCandidate{target: h})
+			continue
+		}
+		ips, err := lookupHostCandidate(name)
+		if err != nil {
+			logger.Log.Warningf("Skipping %s: %v", *h, err)
+			continue
+		}
+		if !Config.ExpandHosts {
+			ips = ips[:1]
+		}
+		for _, ip := range ips {
+			target := net.JoinHostPort(ip.String(), port)
+			targets = append(targets, hostCandidate{target: &target, origin: name})
+		}
+	}
+	return
+}
+
+// queueHostCandidates adds resolved candidates to the pool, each address once
+// per pool however many hostnames resolve to it, and takes up to amount of
+// them. The rest wait for the next batch, since --expand-hosts can turn one
+// hostname into many candidates.
+func (s *SourceIPs) queueHostCandidates(candidates []hostCandidate, amount int) []*string {
+	for _, c := range candidates {
+		if len(c.origin) > 0 {
+			addHostOrigin(*c.target, c.origin)
+			if s.resolvedSeen[*c.target] {
+				continue
+			}
+			if s.resolvedSeen == nil {
+				s.resolvedSeen = make(map[string]bool)
+			}
+			s.resolvedSeen[*c.target] = true
+		}
+		s.resolved = append(s.resolved, c.target)
+	}
+	n := max(0, utils.MinInt(amount, len(s.resolved)))
+	taken := s.resolved[:n:n]
+	s.resolved = s.resolved[n:]
+	return taken
+}
+
+func lookupHostCandidate(name string) ([]net.IP, error) {
+	if Config.ResolveHostsDNS {
+		return fetcher.ResolveHost(Config.DNSServer, name, Config.IPv4Mode, Config.IPv6Mode)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		isV4 := addr.IP.To4() != nil
+		if (isV4 && Config.IPv4Mode) || (!isV4 && Config.IPv6Mode) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable address found for %q", name)
+	}
+	return ips, nil
+}
+
 func (s *SourceIPs) RetrieveSomeNew(amount int) (targetIPs []*string) {
 	return s.RetrieveSome(amount, false)
 }
@@ -838,14 +1322,20 @@ func (s *SourceIPs) retrieveHosts(amount int) (targetHosts []*string) {
 	return
 }
 
+func (s *SourceIPs) pushExtracted(ipr *utils.IPRange) {
+	if ipr.IsV6() {
+		s.srcIPs6.push(ipr.ExtractAll(MaxHostLen)...)
+	} else {
+		s.srcIPs4.push(ipr.ExtractAll(MaxHostLen)...)
+	}
+}
+
 func (s *SourceIPs) hasIP4() bool {
-	for _, ip := range s.srcIPRsExtracted {
-		if ip.To4() != nil {
-			return true
-		}
+	if s.srcIPs4.len() > 0 {
+		return true
 	}
 	for _, ipr := range s.srcIPRsRaw {
-		if !ipr.IsV6() && ipr.Len.Cmp(big.NewInt(0)) > 0 {
+		if ipr.IsV4() {
 			return true
 		}
 	}
@@ -853,67 +1343,76 @@ func (s *SourceIPs) hasIP4() bool {
 }
 
 func (s *SourceIPs) hasIP6() bool {
-	for _, ip := range s.srcIPRsExtracted {
-		if ip.To4() == nil {
-			return true
-		}
+	if s.srcIPs6.len() > 0 {
+		return true
 	}
 	for _, ipr := range s.srcIPRsRaw {
-		if ipr.IsV6() && ipr.Len.Cmp(big.NewInt(0)) > 0 {
+		if ipr.IsV6() {
 			return true
 		}
 	}
 	return false
 }
 
-func (s *SourceIPs) retrieveOneIP(isV6 bool, isRandom bool) net.IP {
-	for i, ip := range s.srcIPRsExtracted {
-		ipIsV6 := ip.To4() == nil
-		if ipIsV6 == isV6 {
-			s.srcIPRsExtracted = append(s.srcIPRsExtracted[:i], s.srcIPRsExtracted[i+1:]...)
-			return ip
-		}
+func (s *SourceIPs) retrieveOneIP(isV6 bool, isRandom bool) netip.Addr {
+	pool := &s.srcIPs4
+	if isV6 {
+		pool = &s.srcIPs6
+	}
+	if ip, ok := pool.pop(); ok {
+		return ip
 	}
 
 	var matchingIndices []int
 	for i, ipr := range s.srcIPRsRaw {
-		if ipr.IsV6() == isV6 && ipr.Len.Cmp(big.NewInt(0)) > 0 {
+		if ipr.IsV6() == isV6 && !ipr.IsEmpty() {
 			matchingIndices = append(matchingIndices, i)
 		}
 	}
 
 	if len(matchingIndices) == 0 {
-		return nil
+		return netip.Addr{}
 	}
 
 	var idx int
 	if isRandom {
-		idx = matchingIndices[MyRand.Intn(len(matchingIndices))]
+		switch Config.Sampling {
+		case SamplingStratified:
+			idx = s.stratifiedRange(matchingIndices)
+		case SamplingWeighted:
+			idx = s.weightedRange(matchingIndices)
+		default:
+			idx = matchingIndices[s.tRnd.Intn(len(matchingIndices))]
+		}
 	} else {
 		idx = matchingIndices[0]
 	}
 
 	ipr := s.srcIPRsRaw[idx]
-	var extracted []net.IP
-	if isRandom {
-		extracted = ipr.GetRandomX(MyRand, 1)
-	} else {
+	var extracted []netip.Addr
+	switch {
+	case isRandom && Config.Sampling == SamplingStratified:
+		extracted = s.stratifiedIP(ipr)
+	case isRandom:
+		extracted = ipr.GetRandomX(s.tRnd, 1)
+	default:
 		extracted = ipr.Extract(1)
 	}
 
-	if ipr.Len.Cmp(big.NewInt(0)) == 0 {
+	if ipr.IsEmpty() {
 		for i, r := range s.srcIPRsRaw {
 			if r == ipr {
 				s.srcIPRsRaw = append(s.srcIPRsRaw[:i], s.srcIPRsRaw[i+1:]...)
 				break
 			}
 		}
+		delete(s.strata, ipr)
 	}
 
 	if len(extracted) > 0 {
 		return extracted[0]
 	}
-	return nil
+	return netip.Addr{}
 }
 
 func (s *SourceIPs) retrieveIPsFromIPR(amount int, isRandom bool) (targetIPs []*string) {
@@ -921,7 +1420,7 @@ func (s *SourceIPs) retrieveIPsFromIPR(amount int, isRandom bool) (targetIPs []*
 		return
 	}
 
-	t_ips := make([]net.IP, 0, amount)
+	t_ips := make([]netip.Addr, 0, amount)
 	for len(t_ips) < amount {
 		hasV4 := s.hasIP4()
 		hasV6 := s.hasIP6()
@@ -931,13 +1430,13 @@ func (s *SourceIPs) retrieveIPsFromIPR(amount int, isRandom bool) (targetIPs []*
 
 		var chooseV6 bool
 		if hasV4 && hasV6 {
-			chooseV6 = MyRand.Float64() < 0.5
+			chooseV6 = s.tRnd.Float64() < 0.5
 		} else {
 			chooseV6 = hasV6
 		}
 
 		ip := s.retrieveOneIP(chooseV6, isRandom)
-		if ip != nil {
+		if ip.IsValid() {
 			t_ips = append(t_ips, ip)
 		} else {
 			break
@@ -949,7 +1448,7 @@ func (s *SourceIPs) retrieveIPsFromIPR(amount int, isRandom bool) (targetIPs []*
 		targetIPs = append(targetIPs, &tIP)
 	}
 
-	MyRand.Shuffle(len(targetIPs), func(m, n int) {
+	s.tRnd.Shuffle(len(targetIPs), func(m, n int) {
 		targetIPs[m], targetIPs[n] = targetIPs[n], targetIPs[m]
 	})
 	return
@@ -958,14 +1457,16 @@ func (s *SourceIPs) retrieveIPsFromIPR(amount int, isRandom bool) (targetIPs []*
 func (s *SourceIPs) Shuffle() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	MyRand.Shuffle(len(s.srcHosts), func(m, n int) {
+	s.tRnd.Shuffle(len(s.srcHosts), func(m, n int) {
 		s.srcHosts[m], s.srcHosts[n] = s.srcHosts[n], s.srcHosts[m]
 	})
-	MyRand.Shuffle(len(s.srcIPRsRaw), func(m, n int) {
+	s.tRnd.Shuffle(len(s.srcIPRsRaw), func(m, n int) {
 		s.srcIPRsRaw[m], s.srcIPRsRaw[n] = s.srcIPRsRaw[n], s.srcIPRsRaw[m]
 	})
-	MyRand.Shuffle(len(s.srcIPRsExtracted), func(m, n int) {
-		s.srcIPRsExtracted[m], s.srcIPRsExtracted[n] = s.srcIPRsExtracted[n], s.srcIPRsExtracted[m]
+	s.srcIPs4.shuffle(s.tRnd)
+	s.srcIPs6.shuffle(s.tRnd)
+	s.tRnd.Shuffle(len(s.srcPortRanges), func(m, n int) {
+		s.srcPortRanges[m], s.srcPortRanges[n] = s.srcPortRanges[n], s.srcPortRanges[m]
 	})
 }
 
@@ -978,19 +1479,26 @@ func (s *SourceIPs) SetRand(mRnd *rand.Rand) {
 func (s *SourceIPs) Reset() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.closeStream()
 	s.srcHosts = []*string{}
+	s.resolved = nil
+	s.resolvedSeen = nil
 	s.srcIPRsRaw = []*utils.IPRange{}
-	s.srcIPRsExtracted = []net.IP{}
+	s.srcIPs4.reset()
+	s.srcIPs6.reset()
+	s.srcPortRanges = nil
+	s.excludes = nil
+	s.excludeSeen = nil
+	s.strata = nil
 	s.Ports = []int{}
 }
 
 func NewSourceIPs() *SourceIPs {
 	return &SourceIPs{
-		srcHosts:         make([]*string, 0),
-		srcIPRsRaw:       make([]*utils.IPRange, 0),
-		srcIPRsExtracted: make([]net.IP, 0),
-		Ports:            []int{},
-		tRnd:             utils.NewRand(),
+		srcHosts:   make([]*string, 0),
+		srcIPRsRaw: make([]*utils.IPRange, 0),
+		Ports:      []int{},
+		tRnd:       MyRand,
 	}
 }
 
@@ -1003,10 +1511,16 @@ func NewSourceIPsWithRand(tRnd *rand.Rand) *SourceIPs {
 func CopySourceIPs(src *SourceIPs) *SourceIPs {
 	mSrc := NewSourceIPs()
 	mSrc.srcHosts = append(mSrc.srcHosts, src.srcHosts...)
+	mSrc.resolved = append(mSrc.resolved, src.resolved...)
+	mSrc.resolvedSeen = maps.Clone(src.resolvedSeen)
 	mSrc.srcIPRsRaw = append(mSrc.srcIPRsRaw, src.srcIPRsRaw...)
-	mSrc.srcIPRsExtracted = append(mSrc.srcIPRsExtracted, src.srcIPRsExtracted...)
+	mSrc.srcIPs4.push(src.srcIPs4.remaining()...)
+	mSrc.srcIPs6.push(src.srcIPs6.remaining()...)
+	mSrc.srcPortRanges = append(mSrc.srcPortRanges, src.srcPortRanges...)
+	mSrc.excludes = append(mSrc.excludes, src.excludes...)
+	mSrc.excludeSeen = maps.Clone(src.excludeSeen)
 	mSrc.Ports = append(mSrc.Ports, src.Ports...)
-	mSrc.tRnd = utils.NewRand()
+	mSrc.tRnd = src.tRnd
 	return mSrc
 }
 
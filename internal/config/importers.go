@@ -0,0 +1,264 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	InputFormatAuto        = "auto"
+	InputFormatPlain       = "plain"
+	InputFormatResultCSV   = "csv"
+	InputFormatMasscanJSON = "masscan-json"
+	InputFormatMasscanList = "masscan-list"
+	InputFormatNmapXML     = "nmap-xml"
+	InputFormatZmap        = "zmap"
+)
+
+var InputFormats = []string{
+	InputFormatAuto,
+	InputFormatPlain,
+	InputFormatResultCSV,
+	InputFormatMasscanJSON,
+	InputFormatMasscanList,
+	InputFormatNmapXML,
+	InputFormatZmap,
+}
+
+// lineConverter turns one input line into zero or more candidates.
+type lineConverter func(line string) ([]string, error)
+
+// itemReader parses a whole input and passes its candidates to send as they
+// are read. It stops early, returning nil, once send returns false.
+type itemReader func(r io.Reader, send func(streamItem) bool) error
+
+// lineItems is the itemReader of line-based formats.
+func lineItems(convert lineConverter) itemReader {
+	return func(r io.Reader, send func(streamItem) bool) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Split(bufio.ScanLines)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 {
+				continue
+			}
+			hosts, err := convert(line)
+			if !send(streamItem{hosts: hosts, err: err}) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+}
+
+func NormalizeInputFormat() error {
+	Config.InFormat = strings.ToLower(strings.TrimSpace(Config.InFormat))
+	if Config.InFormat == "" {
+		Config.InFormat = InputFormatAuto
+	}
+	if !slices.Contains(InputFormats, Config.InFormat) {
+		return fmt.Errorf("invalid value for %q: %q, must be one of %s", "--in-format", Config.InFormat, strings.Join(InputFormats, ", "))
+	}
+	return nil
+}
+
+// detectInputFormat guesses the format from the start of r. A UTF-8 BOM is
+// consumed.
+func detectInputFormat(r *bufio.Reader) string {
+	if isResultCSV(r) {
+		return InputFormatResultCSV
+	}
+	head, _ := r.Peek(512)
+	head = bytes.TrimLeft(head, " \t\r\n")
+	firstLine, _, _ := strings.Cut(string(head), "\n")
+	firstLine = strings.TrimSpace(firstLine)
+	switch {
+	case strings.HasPrefix(firstLine, "<?xml") || strings.HasPrefix(firstLine, "<nmaprun"):
+		return InputFormatNmapXML
+	case strings.HasPrefix(firstLine, "#masscan") || strings.HasPrefix(firstLine, "open "):
+		return InputFormatMasscanList
+	case (strings.HasPrefix(firstLine, "[") || strings.HasPrefix(firstLine, "{")) && bytes.Contains(head, []byte(`"ip"`)):
+		return InputFormatMasscanJSON
+	case strings.HasPrefix(firstLine, "saddr"):
+		return InputFormatZmap
+	}
+	return InputFormatPlain
+}
+
+func plainLine(line string) ([]string, error) {
+	return []string{line}, nil
+}
+
+// masscanListLine reads -oL output: "open tcp 443 1.2.3.4 1700000000".
+func masscanListLine(line string) ([]string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "open" || fields[1] != "tcp" {
+		return nil, nil
+	}
+	if net.ParseIP(fields[3]) == nil {
+		return nil, fmt.Errorf("masscan: invalid address in %q", line)
+	}
+	return []string{net.JoinHostPort(fields[3], fields[2])}, nil
+}
+
+type masscanRecord struct {
+	IP    string `json:"ip"`
+	Ports []struct {
+		Port   int    `json:"port"`
+		Proto  string `json:"proto"`
+		Status string `json:"status"`
+	} `json:"ports"`
+}
+
+// masscanJSONLine reads -oJ output, which has one object per line inside a
+// JSON array, or one per line without it (--ndjson).
+func masscanJSONLine(line string) ([]string, error) {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "["), ",")
+	line = strings.TrimSpace(strings.TrimSuffix(line, "]"))
+	if line == "" || strings.HasPrefix(line, "{finished") {
+		return nil, nil
+	}
+	var record masscanRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return nil, fmt.Errorf("masscan: %w in %q", err, line)
+	}
+	if record.IP == "" {
+		return nil, nil
+	}
+	var hosts []string
+	for _, p := range record.Ports {
+		if (p.Status == "" || p.Status == "open") && (p.Proto == "" || p.Proto == "tcp") {
+			hosts = append(hosts, net.JoinHostPort(record.IP, strconv.Itoa(p.Port)))
+		}
+	}
+	return hosts, nil
+}
+
+// readZmapCSV reads zmap CSV output. With a header naming saddr and sport,
+// rows become host:port candidates and rows with success=0 are dropped;
+// without one, every row is a bare address.
+func readZmapCSV(r io.Reader, send func(streamItem) bool) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	saddr, sport, success := 0, -1, -1
+	headerSeen := false
+	for {
+		cols, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if !send(streamItem{err: fmt.Errorf("zmap: %w", err)}) {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !headerSeen {
+			headerSeen = true
+			if idx := slices.Index(cols, "saddr"); idx >= 0 {
+				saddr, sport, success = idx, slices.Index(cols, "sport"), slices.Index(cols, "success")
+				continue
+			}
+		}
+		if saddr >= len(cols) || (success >= 0 && success < len(cols) && cols[success] != "1") {
+			continue
+		}
+		host := strings.TrimSpace(cols[saddr])
+		if sport >= 0 && sport < len(cols) {
+			host = net.JoinHostPort(host, strings.TrimSpace(cols[sport]))
+		}
+		if !send(streamItem{hosts: []string{host}}) {
+			return nil
+		}
+	}
+}
+
+func itemReaderFor(format string) itemReader {
+	switch format {
+	case InputFormatMasscanList:
+		return lineItems(masscanListLine)
+	case InputFormatMasscanJSON:
+		return lineItems(masscanJSONLine)
+	case InputFormatNmapXML:
+		return readNmapXML
+	case InputFormatZmap:
+		return readZmapCSV
+	}
+	return lineItems(plainLine)
+}
+
+type nmapHost struct {
+	Addresses []struct {
+		Addr     string `xml:"addr,attr"`
+		AddrType string `xml:"addrtype,attr"`
+	} `xml:"address"`
+	Ports []struct {
+		Protocol string `xml:"protocol,attr"`
+		PortID   string `xml:"portid,attr"`
+		State    struct {
+			State string `xml:"state,attr"`
+		} `xml:"state"`
+	} `xml:"ports>port"`
+}
+
+// openPorts returns the open TCP ports of h as host:port candidates.
+func (h nmapHost) openPorts() []string {
+	addr := ""
+	for _, a := range h.Addresses {
+		if a.AddrType == "ipv4" || a.AddrType == "ipv6" {
+			addr = a.Addr
+			break
+		}
+	}
+	if addr == "" {
+		return nil
+	}
+	var hosts []string
+	for _, p := range h.Ports {
+		if p.Protocol == "tcp" && p.State.State == "open" {
+			hosts = append(hosts, net.JoinHostPort(addr, p.PortID))
+		}
+	}
+	return hosts
+}
+
+// readNmapXML reads nmap -oX output one <host> element at a time, so a scan
+// of millions of hosts is never decoded whole.
+func readNmapXML(r io.Reader, send func(streamItem) bool) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("nmap: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "host" {
+			continue
+		}
+		var host nmapHost
+		if err := decoder.DecodeElement(&host, &start); err != nil {
+			return fmt.Errorf("nmap: %w", err)
+		}
+		if hosts := host.openPorts(); len(hosts) > 0 && !send(streamItem{hosts: hosts}) {
+			return nil
+		}
+	}
+}
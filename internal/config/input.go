@@ -0,0 +1,199 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// InputRecord is one previous result read back as scan input, from a result
+// CSV or the CFTD table.
+type InputRecord struct {
+	Host  string
+	Speed float64
+	Delay float64
+	Colo  string
+}
+
+// DBSourceLoader reads InputRecords from a SQLite file for --in-db. It is set
+// by the db package's caller, since config cannot import db.
+var DBSourceLoader func(path, query string) ([]InputRecord, error)
+
+// InputCondition is one --input-filter term, such as dls>=1000 or colo=HKG|NRT.
+type InputCondition struct {
+	Field string
+	Op    string
+	Value float64
+	Colos []string
+}
+
+type InputFilter []InputCondition
+
+var inputFilterOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// ParseInputFilter parses a comma-separated --input-filter expression. Fields
+// are dls (speed), da (delay) and colo (loc).
+func ParseInputFilter(raw string) (InputFilter, error) {
+	var filter InputFilter
+	for _, term := range strings.Split(raw, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		cond := InputCondition{}
+		var value string
+		for _, op := range inputFilterOps {
+			if field, rest, ok := strings.Cut(term, op); ok {
+				cond.Field, cond.Op = strings.ToLower(strings.TrimSpace(field)), op
+				value = strings.TrimSpace(rest)
+				break
+			}
+		}
+		switch cond.Field {
+		case "dls", "speed":
+			cond.Field = "dls"
+		case "da", "delay":
+			cond.Field = "da"
+		case "colo", "loc":
+			cond.Field = "colo"
+		default:
+			return nil, fmt.Errorf("invalid value for %q: %q must compare dls, da or colo", "--input-filter", term)
+		}
+		if cond.Field == "colo" {
+			if cond.Op != "=" && cond.Op != "!=" {
+				return nil, fmt.Errorf("invalid value for %q: colo only supports = and !=", "--input-filter")
+			}
+			for _, colo := range strings.Split(value, "|") {
+				if colo = strings.ToUpper(strings.TrimSpace(colo)); colo != "" {
+					cond.Colos = append(cond.Colos, colo)
+				}
+			}
+			if len(cond.Colos) == 0 {
+				return nil, fmt.Errorf("invalid value for %q: missing colo", "--input-filter")
+			}
+		} else {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %q is not a number", "--input-filter", value)
+			}
+			cond.Value = v
+		}
+		filter = append(filter, cond)
+	}
+	return filter, nil
+}
+
+// Match reports whether r satisfies every condition.
+func (f InputFilter) Match(r InputRecord) bool {
+	for _, c := range f {
+		if c.Field == "colo" {
+			if slices.Contains(c.Colos, strings.ToUpper(r.Colo)) != (c.Op == "=") {
+				return false
+			}
+			continue
+		}
+		v := r.Speed
+		if c.Field == "da" {
+			v = r.Delay
+		}
+		var ok bool
+		switch c.Op {
+		case ">=":
+			ok = v >= c.Value
+		case "<=":
+			ok = v <= c.Value
+		case ">":
+			ok = v > c.Value
+		case "<":
+			ok = v < c.Value
+		case "=":
+			ok = v == c.Value
+		case "!=":
+			ok = v != c.Value
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isResultCSV reports whether r starts with our own ResultCsvHeader, skipping
+// a UTF-8 BOM, which is consumed.
+func isResultCSV(r *bufio.Reader) bool {
+	if head, err := r.Peek(len(UTF8BomBytes)); err == nil && bytes.Equal(head, UTF8BomBytes) {
+		_, _ = r.Discard(len(UTF8BomBytes))
+	}
+	prefix := CsvTestTime + "," + CsvIP + ","
+	head, _ := r.Peek(len(prefix))
+	return string(head) == prefix
+}
+
+// readResultCSV reads the IP, speed, delay and colo columns of a result CSV.
+// Columns are found by header name, so files written by older versions with
+// fewer columns still load.
+func readResultCSV(r io.Reader) ([]InputRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	column := func(name string) int {
+		return slices.Index(header, name)
+	}
+	ipCol, dlsCol, daCol, locCol := column(CsvIP), column(CsvDLS), column(CsvDA), column(CsvLoc)
+	if ipCol < 0 {
+		return nil, fmt.Errorf("missing IP column")
+	}
+	field := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	var records []InputRecord
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := InputRecord{Host: field(row, ipCol), Colo: field(row, locCol)}
+		if record.Host == "" {
+			continue
+		}
+		record.Speed, _ = strconv.ParseFloat(field(row, dlsCol), 64)
+		record.Delay, _ = strconv.ParseFloat(field(row, daCol), 64)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (s *SourceIPs) addRecords(records []InputRecord, mode int8) error {
+	seen := make(map[string]bool, len(records))
+	for _, r := range records {
+		if seen[r.Host] || !Config.InputFilterRules.Match(r) {
+			continue
+		}
+		seen[r.Host] = true
+		if err := s.add(r.Host, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddFromRecords adds previous results that pass --input-filter.
+func (s *SourceIPs) AddFromRecords(records []InputRecord, mode int8) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addRecords(records, mode)
+}
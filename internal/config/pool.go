@@ -0,0 +1,50 @@
+package config
+
+import (
+	"math/rand"
+	"net/netip"
+)
+
+// addrPool is a queue of expanded addresses of one family. Taking from the
+// front only advances head, so draining a pool is linear in its size.
+type addrPool struct {
+	addrs []netip.Addr
+	head  int
+}
+
+func (p *addrPool) push(addrs ...netip.Addr) {
+	p.addrs = append(p.addrs, addrs...)
+}
+
+func (p *addrPool) len() int {
+	return len(p.addrs) - p.head
+}
+
+func (p *addrPool) pop() (netip.Addr, bool) {
+	if p.head >= len(p.addrs) {
+		return netip.Addr{}, false
+	}
+	addr := p.addrs[p.head]
+	p.head++
+	if p.head == len(p.addrs) {
+		p.reset()
+	}
+	return addr, true
+}
+
+// remaining returns the addresses not taken yet, sharing the backing array.
+func (p *addrPool) remaining() []netip.Addr {
+	return p.addrs[p.head:]
+}
+
+func (p *addrPool) shuffle(r *rand.Rand) {
+	rest := p.remaining()
+	r.Shuffle(len(rest), func(m, n int) {
+		rest[m], rest[n] = rest[n], rest[m]
+	})
+}
+
+func (p *addrPool) reset() {
+	p.addrs = p.addrs[:0]
+	p.head = 0
+}
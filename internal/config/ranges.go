@@ -0,0 +1,238 @@
+package config
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cftestor/internal/utils"
+)
+
+// portRange is a source entry carrying its own ports, such as
+// 104.16.0.0/13:443,2053, which are used instead of the global -p.
+type portRange struct {
+	ipr   *utils.IPRange
+	ports []int
+}
+
+var (
+	portListRegex       = regexp.MustCompile(`[,;|]+`)
+	portRangeRegex      = regexp.MustCompile(`^\d+[-:]\d+$`)
+	portRangeSplitRegex = regexp.MustCompile(`[-:]`)
+	portFragmentRegex   = regexp.MustCompile(`^\d+(-\d+)?$`)
+)
+
+// parsePorts parses a port list in the -p syntax: 443,2053;8443|2083-2087.
+func parsePorts(portStr string) ([]int, error) {
+	var ports []int
+	for _, portValue := range portListRegex.Split(portStr, -1) {
+		portValue = strings.TrimSpace(portValue)
+		if len(portValue) == 0 {
+			continue
+		}
+		if portRangeRegex.MatchString(portValue) {
+			portList := portRangeSplitRegex.Split(portValue, -1)
+			if len(portList) != 2 {
+				return nil, invalidPortFlagError(portValue)
+			}
+			startPort, err := strconv.Atoi(portList[0])
+			if err != nil {
+				return nil, invalidPortFlagError(portList[0])
+			}
+			endPort, err := strconv.Atoi(portList[1])
+			if err != nil {
+				return nil, invalidPortFlagError(portList[1])
+			}
+			if startPort > endPort || startPort < 1 || endPort > 65535 {
+				return nil, invalidPortFlagError(portValue)
+			}
+			for i := startPort; i <= endPort; i++ {
+				ports = append(ports, i)
+			}
+		} else {
+			port, err := strconv.Atoi(portValue)
+			if err != nil || port < 1 || port > 65535 {
+				return nil, invalidPortFlagError(portValue)
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// parseIPRange parses "start-end", where both ends are addresses of the same
+// family.
+func parseIPRange(ips string) *utils.IPRange {
+	startStr, endStr, ok := strings.Cut(ips, "-")
+	if !ok {
+		return nil
+	}
+	startStr, endStr = strings.TrimSpace(startStr), strings.TrimSpace(endStr)
+	start, end := net.ParseIP(startStr), net.ParseIP(endStr)
+	if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+		return nil
+	}
+	return utils.NewIPRangeFromString(&startStr, &endStr)
+}
+
+// parseIPBlock parses an IP, a CIDR or a start-end range.
+func parseIPBlock(ips string) *utils.IPRange {
+	if strings.Contains(ips, "-") {
+		return parseIPRange(ips)
+	}
+	if utils.IsValidIPs(ips) {
+		return utils.NewIPRangeFromCIDR(&ips)
+	}
+	return nil
+}
+
+// splitEntryPorts splits "block:ports". IPv6 blocks need a prefix length or
+// brackets, e.g. 2606:4700::/32:443 or [2606:4700::1-2606:4700::ff]:443.
+func splitEntryPorts(ips string) (block, ports string, ok bool) {
+	if strings.HasPrefix(ips, "[") {
+		end := strings.Index(ips, "]:")
+		if end < 0 {
+			return "", "", false
+		}
+		return ips[1:end], ips[end+2:], true
+	}
+	if slash := strings.Index(ips, "/"); slash >= 0 {
+		colon := strings.Index(ips[slash:], ":")
+		if colon < 0 {
+			return "", "", false
+		}
+		return ips[:slash+colon], ips[slash+colon+1:], true
+	}
+	if strings.Count(ips, ":") == 1 {
+		return strings.Cut(ips, ":")
+	}
+	return "", "", false
+}
+
+func iprVer(ipr *utils.IPRange) int8 {
+	if ipr.IsV6() {
+		return TypeIPv6
+	}
+	return TypeIPv4
+}
+
+// addWithPorts adds a block that has its own ports. Small blocks are
+// expanded to host:port candidates right away.
+func (s *SourceIPs) addWithPorts(ipr *utils.IPRange, ports []int, mode int8) {
+	if tV := iprVer(ipr); (tV & mode) != tV {
+		return
+	}
+	ports = utils.UniqueIntSlice(ports)
+	total := new(big.Int).Mul(ipr.Length(), big.NewInt(int64(len(ports))))
+	if total.Cmp(MaxHostLenBig) > 0 {
+		s.srcPortRanges = append(s.srcPortRanges, &portRange{ipr: ipr, ports: ports})
+		return
+	}
+	for _, ip := range ipr.ExtractAll(MaxHostLen) {
+		for _, port := range ports {
+			host := utils.GenHostFromIPStrPort(ip.String(), port)
+			s.srcHosts = append(s.srcHosts, &host)
+		}
+	}
+}
+
+// addExclusion records a !block line. Exclusions apply to every candidate
+// retrieved afterwards, whatever input it came from. A streamed -i file has
+// its exclusions loaded before streaming starts, see loadExclusions.
+func (s *SourceIPs) addExclusion(ips string) error {
+	if s.excludeSeen[ips] {
+		return nil
+	}
+	ipr := parseIPBlock(ips)
+	if ipr == nil {
+		return fmt.Errorf("the exclusion %q is not a valid IP, CIDR or range", "!"+ips)
+	}
+	s.excludes = append(s.excludes, ipr)
+	if s.excludeSeen == nil {
+		s.excludeSeen = make(map[string]bool)
+	}
+	s.excludeSeen[ips] = true
+	return nil
+}
+
+// dropFiltered removes candidates whose address is excluded, and those of
+// other shards. Filtering happens after the draw, so TotalHosts and the
+// progress counts still include the candidates of every shard.
+func (s *SourceIPs) dropFiltered(hosts []*string) []*string {
+	if len(s.excludes) == 0 && Config.ShardCount <= 1 {
+		return hosts
+	}
+	kept := hosts[:0]
+	for _, host := range hosts {
+		if !inShard(*host) {
+			continue
+		}
+		ipStr := *host
+		if h, _, err := net.SplitHostPort(ipStr); err == nil {
+			ipStr = h
+		}
+		if ip, err := netip.ParseAddr(ipStr); err == nil && s.isExcluded(ip) {
+			continue
+		}
+		kept = append(kept, host)
+	}
+	return kept
+}
+
+func (s *SourceIPs) isExcluded(ip netip.Addr) bool {
+	for _, ex := range s.excludes {
+		if ex.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// retrievePortRanges takes addresses from blocks with their own ports until
+// about amount candidates are collected.
+func (s *SourceIPs) retrievePortRanges(amount int, isRandom bool) (targetIPs []*string) {
+	for len(targetIPs) < amount && len(s.srcPortRanges) > 0 {
+		idx := 0
+		if isRandom {
+			idx = s.tRnd.Intn(len(s.srcPortRanges))
+		}
+		pr := s.srcPortRanges[idx]
+		var extracted []netip.Addr
+		if isRandom {
+			extracted = pr.ipr.GetRandomX(s.tRnd, 1)
+		} else {
+			extracted = pr.ipr.Extract(1)
+		}
+		if len(extracted) == 0 || pr.ipr.IsEmpty() {
+			s.srcPortRanges = append(s.srcPortRanges[:idx], s.srcPortRanges[idx+1:]...)
+		}
+		for _, ip := range extracted {
+			for _, port := range pr.ports {
+				host := utils.GenHostFromIPStrPort(ip.String(), port)
+				targetIPs = append(targetIPs, &host)
+			}
+		}
+	}
+	return
+}
+
+// mergePortFragments rejoins entries such as 104.16.0.0/13:443,2053 that
+// the comma-separated -s flag has split into "104.16.0.0/13:443" and "2053".
+func mergePortFragments(entries []string) []string {
+	merged := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		trimmed := strings.TrimSpace(entry)
+		if n := len(merged); n > 0 && portFragmentRegex.MatchString(trimmed) {
+			if _, _, ok := splitEntryPorts(strings.TrimSpace(merged[n-1])); ok {
+				merged[n-1] += "," + trimmed
+				continue
+			}
+		}
+		merged = append(merged, entry)
+	}
+	return merged
+}
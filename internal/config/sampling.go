@@ -0,0 +1,161 @@
+package config
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"cftestor/internal/utils"
+)
+
+const (
+	SamplingUniform    = "uniform"
+	SamplingWeighted   = "weighted"
+	SamplingStratified = "stratified"
+)
+
+var SamplingModes = []string{SamplingUniform, SamplingWeighted, SamplingStratified}
+
+// stratum block sizes: one /24 for IPv4, one /48 for IPv6
+const (
+	stratumHostBitsV4 = 8
+	stratumHostBitsV6 = 80
+)
+
+func NormalizeSampling() error {
+	Config.Sampling = strings.ToLower(strings.TrimSpace(Config.Sampling))
+	if Config.Sampling == "" {
+		Config.Sampling = SamplingUniform
+	}
+	if !slices.Contains(SamplingModes, Config.Sampling) {
+		return fmt.Errorf("invalid value for %q: %q, must be one of %s", "--sampling", Config.Sampling, strings.Join(SamplingModes, ", "))
+	}
+	if Config.StratifyK < 1 {
+		return fmt.Errorf("invalid value for %q: %d, must be at least 1", "--stratify-k", Config.StratifyK)
+	}
+	return nil
+}
+
+// keepRangesRaw reports whether ranges must stay whole instead of being
+// expanded when added, so that sampling can see their real size.
+func keepRangesRaw() bool {
+	return Config.Sampling == SamplingWeighted || Config.Sampling == SamplingStratified
+}
+
+// stratum tracks the stratified walk over one range: the block being
+// sampled, the picks taken from it, and the blocks finished in this pass.
+type stratum struct {
+	blocks  *big.Int
+	current *big.Int
+	visited *big.Int
+	picks   int
+}
+
+// weightedRange picks one of indices in proportion to the range sizes.
+func (s *SourceIPs) weightedRange(indices []int) int {
+	total := big.NewInt(0)
+	for _, i := range indices {
+		total.Add(total, s.srcIPRsRaw[i].Length())
+	}
+	if total.Sign() == 0 {
+		return indices[0]
+	}
+	n := new(big.Int).Rand(s.tRnd, total)
+	for _, i := range indices {
+		n.Sub(n, s.srcIPRsRaw[i].Length())
+		if n.Sign() < 0 {
+			return i
+		}
+	}
+	return indices[len(indices)-1]
+}
+
+func stratumHostBits(ipr *utils.IPRange) uint {
+	if ipr.IsV6() {
+		return stratumHostBitsV6
+	}
+	return stratumHostBitsV4
+}
+
+func (s *SourceIPs) stratumOf(ipr *utils.IPRange) *stratum {
+	if s.strata == nil {
+		s.strata = make(map[*utils.IPRange]*stratum)
+	}
+	st, ok := s.strata[ipr]
+	if !ok {
+		blocks := ipr.BlockCount(stratumHostBits(ipr))
+		// start at a random block so repeated runs do not all begin at
+		// the bottom of each range
+		st = &stratum{blocks: blocks, current: new(big.Int).Rand(s.tRnd, blocks), visited: big.NewInt(0)}
+		s.strata[ipr] = st
+	}
+	return st
+}
+
+// remaining returns how many blocks of the range are still due picks in
+// the current pass.
+func (st *stratum) remaining() *big.Int {
+	n := new(big.Int).Sub(st.blocks, st.visited)
+	if n.Sign() < 0 {
+		n.SetInt64(0)
+	}
+	return n
+}
+
+// next moves on to the following block, wrapping around the range.
+func (st *stratum) next() {
+	st.picks = 0
+	st.visited.Add(st.visited, big.NewInt(1))
+	st.current.Add(st.current, big.NewInt(1))
+	if st.current.Cmp(st.blocks) >= 0 {
+		st.current.SetInt64(0)
+	}
+}
+
+// stratifiedRange picks the range to draw from next so that every block of
+// every range gets StratifyK picks before any block is revisited. Ranges
+// are chosen in proportion to the blocks they have left in the current
+// pass.
+func (s *SourceIPs) stratifiedRange(indices []int) int {
+	total := big.NewInt(0)
+	for _, i := range indices {
+		total.Add(total, s.stratumOf(s.srcIPRsRaw[i]).remaining())
+	}
+	if total.Sign() == 0 {
+		// every block has had its picks: start a new pass
+		for _, i := range indices {
+			s.stratumOf(s.srcIPRsRaw[i]).visited.SetInt64(0)
+		}
+		return s.stratifiedRange(indices)
+	}
+	n := new(big.Int).Rand(s.tRnd, total)
+	for _, i := range indices {
+		n.Sub(n, s.stratumOf(s.srcIPRsRaw[i]).remaining())
+		if n.Sign() < 0 {
+			return i
+		}
+	}
+	return indices[len(indices)-1]
+}
+
+// stratifiedIP draws the next address of the current block of ipr, without
+// replacement. Blocks with no addresses left are skipped and count as
+// visited, so a non-empty range always yields an address.
+func (s *SourceIPs) stratifiedIP(ipr *utils.IPRange) []netip.Addr {
+	st := s.stratumOf(ipr)
+	for !ipr.IsEmpty() {
+		ip, ok := ipr.DrawInBlock(s.tRnd, stratumHostBits(ipr), st.current)
+		if !ok {
+			st.next()
+			continue
+		}
+		st.picks++
+		if st.picks >= Config.StratifyK {
+			st.next()
+		}
+		return []netip.Addr{ip}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ParseShard parses --shard "i/n", where 1 <= i <= n.
+func ParseShard(raw string) (index, count int, err error) {
+	indexStr, countStr, ok := strings.Cut(strings.TrimSpace(raw), "/")
+	if ok {
+		index, err = strconv.Atoi(strings.TrimSpace(indexStr))
+		if err == nil {
+			count, err = strconv.Atoi(strings.TrimSpace(countStr))
+		}
+	}
+	if !ok || err != nil || count < 1 || index < 1 || index > count {
+		return 0, 0, fmt.Errorf("invalid value for %q: %q, must be i/n with 1 <= i <= n, e.g. 2/3", "--shard", raw)
+	}
+	return index, count, nil
+}
+
+// ShardOf returns the 1-based shard of a candidate. Addresses are hashed in
+// canonical form, so every machine assigns a candidate to the same shard
+// however it was written or drawn.
+func ShardOf(host string, count int) int {
+	if addrPort, err := netip.ParseAddrPort(host); err == nil {
+		host = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()).String()
+	} else if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.Unmap().String()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	return int(h.Sum64()%uint64(count)) + 1
+}
+
+func inShard(host string) bool {
+	return Config.ShardCount <= 1 || ShardOf(host, Config.ShardCount) == Config.ShardIndex
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cftestor/internal/logger"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// hostStream feeds a SourceIPs from an input as candidates are retrieved, so
+// huge lists are never held in memory at once. A goroutine reads and parses
+// the input ahead into items, so a slow stdin or disk never blocks while the
+// pool is locked.
+type hostStream struct {
+	name  string
+	mode  int8
+	items chan streamItem
+	stop  chan struct{}
+}
+
+// streamItem is the candidates of one input line or record, or why it was
+// rejected.
+type streamItem struct {
+	hosts []string
+	err   error
+}
+
+func newHostStream(name string, mode int8, reader io.Reader, closer io.Closer, read itemReader) *hostStream {
+	st := &hostStream{
+		name:  name,
+		mode:  mode,
+		items: make(chan streamItem, SourceStreamPrefetch),
+		stop:  make(chan struct{}),
+	}
+	go st.readAhead(reader, closer, read)
+	return st
+}
+
+// readAhead owns the input: it is closed here, when the input ends or the
+// stream is stopped.
+func (st *hostStream) readAhead(reader io.Reader, closer io.Closer, read itemReader) {
+	defer close(st.items)
+	defer closer.Close()
+	send := func(item streamItem) bool {
+		select {
+		case st.items <- item:
+			return true
+		case <-st.stop:
+			return false
+		}
+	}
+	if err := read(reader, send); err != nil {
+		send(streamItem{err: fmt.Errorf("error reading %q: %w", st.name, err)})
+	}
+}
+
+// next waits for up to n items. done is set once the input has ended.
+func (st *hostStream) next(n int) (items []streamItem, done bool) {
+	for len(items) < n {
+		item, ok := <-st.items
+		if !ok {
+			return items, true
+		}
+		items = append(items, item)
+	}
+	return items, false
+}
+
+// openInput opens path, or stdin for "-", and transparently decompresses
+// gzip and zstd content.
+func openInput(path string) (*bufio.Reader, io.Closer, error) {
+	var raw io.ReadCloser = io.NopCloser(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file %q is not accessible: %w", path, err)
+		}
+		raw = f
+	}
+	reader := bufio.NewReader(raw)
+	head, _ := reader.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			raw.Close()
+			return nil, nil, fmt.Errorf("failed to read gzip input %q: %w", path, err)
+		}
+		return bufio.NewReader(gz), multiCloser{gz, raw}, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			raw.Close()
+			return nil, nil, fmt.Errorf("failed to read zstd input %q: %w", path, err)
+		}
+		return bufio.NewReader(zr), multiCloser{zr.IOReadCloser(), raw}, nil
+	}
+	return reader, raw, nil
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *SourceIPs) bufferedLen() int {
+	return len(s.srcHosts) + len(s.resolved) + len(s.srcIPRsRaw) + s.srcIPs4.len() + s.srcIPs6.len() + len(s.srcPortRanges)
+}
+
+// fill reads lines from the stream until at least want candidates are
+// buffered or the input ends. s.mu must not be held: it is only taken to add
+// the lines, never while waiting for them.
+func (s *SourceIPs) fill(want int) error {
+	return s.fillStream(want, false)
+}
+
+// fillLenient is fill for streams that are already being consumed: bad lines
+// are logged and skipped instead of failing the scan.
+func (s *SourceIPs) fillLenient(want int) {
+	_ = s.fillStream(want, true)
+}
+
+func (s *SourceIPs) fillStream(want int, lenient bool) error {
+	for {
+		s.mu.Lock()
+		st, need := s.stream, want-s.bufferedLen()
+		s.mu.Unlock()
+		if st == nil || need <= 0 {
+			return nil
+		}
+		items, done := st.next(need)
+
+		s.mu.Lock()
+		err := s.addStreamItems(st, items, lenient)
+		if done && s.stream == st {
+			s.stream = nil
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *SourceIPs) addStreamItems(st *hostStream, items []streamItem, lenient bool) error {
+	for _, item := range items {
+		err := item.err
+		for _, host := range item.hosts {
+			if err != nil {
+				break
+			}
+			err = s.add(host, st.mode)
+		}
+		if err == nil {
+			continue
+		}
+		if !lenient {
+			return err
+		}
+		logger.Log.Warningf("Skipping input: %v", err)
+	}
+	return nil
+}
+
+func (s *SourceIPs) closeStream() {
+	if s.stream != nil {
+		close(s.stream.stop)
+		s.stream = nil
+	}
+}
+
+// loadExclusions reads the "!" lines of a file before it is streamed, so they
+// also drop candidates listed above them. Invalid ones are left for the
+// stream to report. stdin cannot be read twice, so there an exclusion only
+// drops candidates retrieved after it was read.
+func (s *SourceIPs) loadExclusions(filename string) error {
+	reader, closer, err := openInput(filename)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.Split(scanner.Text(), "#")[0])
+		if strings.HasPrefix(line, "!") {
+			_ = s.addExclusion(strings.TrimSpace(line[1:]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %q: %w", filename, err)
+	}
+	return nil
+}
+
+// Streaming reports whether part of the input has not been read yet, so
+// counts only cover what is buffered.
+func (s *SourceIPs) Streaming() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream != nil
+}
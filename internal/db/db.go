@@ -13,25 +13,43 @@ const (
 )
 
 type DBRecord struct {
-	TestTimeStr string  `gorm:"column:TestTime"`
-	Asn         int     `gorm:"column:ASN"`
-	City        string  `gorm:"column:CITY"`
-	Loc         string  `gorm:"column:LOC"`
-	IP          string  `gorm:"column:IP"`
-	Label       string  `gorm:"column:LABEL"`
-	DS          string  `gorm:"column:DS"`
-	DTC         int     `gorm:"column:DTC"`
-	DTPC        int     `gorm:"column:DTPC"`
-	DTPR        float64 `gorm:"column:DTPR"`
-	DA          float64 `gorm:"column:DA"`
-	DMI         float64 `gorm:"column:DMI"`
-	DMX         float64 `gorm:"column:DMX"`
-	DLTC        int     `gorm:"column:DLTC"`
-	DLTPC       int     `gorm:"column:DLTPC"`
-	DLTPR       float64 `gorm:"column:DLTPR"`
-	DLS         float64 `gorm:"column:DLS"`
-	DLDS        int64   `gorm:"column:DLDS"`
-	DLTD        float64 `gorm:"column:DLTD"`
+	TestTimeStr string  `gorm:"column:TestTime" json:"test_time"`
+	Asn         int     `gorm:"column:ASN" json:"asn"`
+	City        string  `gorm:"column:CITY" json:"city"`
+	Loc         string  `gorm:"column:LOC" json:"loc"`
+	IP          string  `gorm:"column:IP" json:"ip"`
+	Label       string  `gorm:"column:LABEL" json:"label"`
+	DS          string  `gorm:"column:DS" json:"ds"`
+	DTC         int     `gorm:"column:DTC" json:"dtc"`
+	DTPC        int     `gorm:"column:DTPC" json:"dtpc"`
+	DTPR        float64 `gorm:"column:DTPR" json:"dtpr"`
+	DA          float64 `gorm:"column:DA" json:"da"`
+	DMI         float64 `gorm:"column:DMI" json:"dmi"`
+	DMX         float64 `gorm:"column:DMX" json:"dmx"`
+	DLTC        int     `gorm:"column:DLTC" json:"dltc"`
+	DLTPC       int     `gorm:"column:DLTPC" json:"dltpc"`
+	DLTPR       float64 `gorm:"column:DLTPR" json:"dltpr"`
+	DLS         float64 `gorm:"column:DLS" json:"dls"`
+	DLDS        int64   `gorm:"column:DLDS" json:"dlds"`
+	DLTD        float64 `gorm:"column:DLTD" json:"dltd"`
+	Proto       string  `gorm:"column:PROTO" json:"proto"`
+	TLSVersion  string  `gorm:"column:TLSV" json:"tls_version"`
+	Cipher      string  `gorm:"column:CIPHER" json:"cipher"`
+	CertSubject string  `gorm:"column:CSUB" json:"cert_subject"`
+	CertIssuer  string  `gorm:"column:CISS" json:"cert_issuer"`
+	CertSANs    string  `gorm:"column:CSAN" json:"cert_sans"`
+	SPKI        string  `gorm:"column:SPKI" json:"spki"`
+	CertChain   string  `gorm:"column:CHAIN" json:"cert_chain"`
+	CertOutlier bool    `gorm:"column:COUT" json:"cert_outlier"`
+	HTTPStatus  int     `gorm:"column:HST" json:"http_status"`
+	CFRay       bool    `gorm:"column:RAY" json:"cf_ray"`
+	Fronting    string  `gorm:"column:FRONT" json:"fronting"`
+	ProxyAvg    float64 `gorm:"column:PXA" json:"proxy_avg"`
+	EdgeAvg     float64 `gorm:"column:EGA" json:"edge_avg"`
+	SourceAddrs string  `gorm:"column:SRC" json:"source_addrs"`
+	Origin      string  `gorm:"column:ORIG" json:"origin"`
+	Seed        int64   `gorm:"column:SEED" json:"seed"`
+	FailReason  string  `gorm:"column:FAIL" json:"fail_reason"`
 }
 
 func (a *DBRecord) TableName() string {
@@ -47,6 +65,14 @@ func OpenSqlite(dbFilePath string) (*gorm.DB, error) {
 	})
 }
 
+// CloseSqlite closes the connection pool behind db, so handlers that open
+// the database per request do not leak file handles.
+func CloseSqlite(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		_ = sqlDB.Close()
+	}
+}
+
 func AddTableCFDT(db *gorm.DB) error {
 	return db.AutoMigrate(&DBRecord{})
 }
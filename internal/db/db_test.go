@@ -1,9 +1,11 @@
 package db
 
 import (
+	"bytes"
 	"encoding/csv"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -110,6 +112,7 @@ func TestWriteCSVResultAndReadBack(t *testing.T) {
 			DLTPC:       1,
 			DLTPR:       1.0,
 			DLS:         20000.5,
+			FailReason:  "status 403, want 200",
 		},
 	}
 
@@ -146,6 +149,54 @@ func TestWriteCSVResultAndReadBack(t *testing.T) {
 	if rows[1][1] != "1.1.1.1:443" {
 		t.Errorf("expected data column 1 to be 1.1.1.1:443, got %s", rows[1][1])
 	}
+	if last := len(rows[1]) - 1; rows[0][last] != "FailReason(FAIL)" || rows[1][last] != "status 403, want 200" {
+		t.Errorf("expected the fail reason in the last column, got %s=%s", rows[0][last], rows[1][last])
+	}
+}
+
+func TestWriteCSVResultKeepsOldHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "results.csv")
+	old := "IP,Delay\n1.0.0.1:443,12\n"
+	if err := os.WriteFile(csvPath, []byte(old), 0644); err != nil {
+		t.Fatalf("os.WriteFile failed: %v", err)
+	}
+
+	records := []DBRecord{{TestTimeStr: "2026-08-21 12:00:00", IP: "1.1.1.1:443", DS: "https"}}
+	if err := WriteCSVResult(records, csvPath); err != nil {
+		t.Fatalf("WriteCSVResult failed: %v", err)
+	}
+	if err := WriteCSVResult(records, csvPath); err != nil {
+		t.Fatalf("second WriteCSVResult failed: %v", err)
+	}
+
+	content, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile failed: %v", err)
+	}
+	if string(content) != old {
+		t.Errorf("file with the old header was modified: %q", content)
+	}
+	altPath := filepath.Join(tmpDir, "results.1.csv")
+	header, err := readCSVHeader(altPath)
+	if err != nil {
+		t.Fatalf("readCSVHeader failed: %v", err)
+	}
+	if strings.Join(header, ",") != strings.Join(config.ResultCsvHeader, ",") {
+		t.Errorf("unexpected header in %s: %v", altPath, header)
+	}
+	alt, err := os.Open(altPath)
+	if err != nil {
+		t.Fatalf("os.Open failed: %v", err)
+	}
+	defer alt.Close()
+	rows, err := ReadCSVResult(alt)
+	if err != nil {
+		t.Fatalf("ReadCSVResult failed: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Errorf("expected both writes in %s, got %d rows", altPath, len(rows))
+	}
 }
 
 func TestGenDBRecords(t *testing.T) {
@@ -182,3 +233,135 @@ func TestGenDBRecords(t *testing.T) {
 		t.Errorf("DBRecord mismatch: %+v", rec)
 	}
 }
+
+func TestLoadInputRecords(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "results.db")
+	records := []DBRecord{
+		{TestTimeStr: "2026-10-18 10:00:00", IP: "104.16.1.1:443", Label: "home", Loc: "HKG", DA: 80, DLS: 2500},
+		{TestTimeStr: "2026-10-18 11:00:00", IP: "104.16.1.2:443", Label: "work", Loc: "NRT", DA: 60, DLS: 500},
+	}
+	if err := SaveDBRecords(records, dbPath); err != nil {
+		t.Fatalf("SaveDBRecords failed: %v", err)
+	}
+
+	all, err := LoadInputRecords(dbPath, "")
+	if err != nil {
+		t.Fatalf("LoadInputRecords failed: %v", err)
+	}
+	if len(all) != 2 || all[0].Host != "104.16.1.2:443" {
+		t.Fatalf("expected both rows newest first, got %+v", all)
+	}
+	home, err := LoadInputRecords(dbPath, "LABEL = 'home'")
+	if err != nil {
+		t.Fatalf("LoadInputRecords with query failed: %v", err)
+	}
+	if len(home) != 1 || home[0].Host != "104.16.1.1:443" || home[0].Speed != 2500 || home[0].Colo != "HKG" {
+		t.Fatalf("unexpected rows: %+v", home)
+	}
+	if _, err := LoadInputRecords(filepath.Join(t.TempDir(), "missing.db"), ""); err == nil {
+		t.Fatal("expected a missing database to fail")
+	}
+}
+
+func TestMergeShardResults(t *testing.T) {
+	tmpDir := t.TempDir()
+	shard1, shard2 := filepath.Join(tmpDir, "shard1.csv"), filepath.Join(tmpDir, "shard2.csv")
+	if err := WriteCSVResult([]DBRecord{
+		{TestTimeStr: "2026-10-18 10:00:00", IP: "104.16.1.1:443", Asn: 4134, City: "Shanghai", Loc: "HKG", DA: 80, DLS: 2500, DTPR: 0.75, CFRay: true, Seed: 7},
+		{TestTimeStr: "2026-10-18 10:00:00", IP: "104.16.1.2:443", Loc: "NRT", DA: 60, DLS: 500, Seed: 7},
+	}, shard1); err != nil {
+		t.Fatalf("WriteCSVResult failed: %v", err)
+	}
+	if err := WriteCSVResult([]DBRecord{
+		{TestTimeStr: "2026-10-18 11:00:00", IP: "104.16.1.2:443", Loc: "NRT", DA: 50, DLS: 3000, Seed: 8},
+		{TestTimeStr: "2026-10-18 11:00:00", IP: "104.16.1.3:443", Loc: "LAX", DA: 40, DLS: 2500, Seed: 8},
+	}, shard2); err != nil {
+		t.Fatalf("WriteCSVResult failed: %v", err)
+	}
+
+	first, err := LoadResults(shard1)
+	if err != nil {
+		t.Fatalf("LoadResults failed: %v", err)
+	}
+	if len(first) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(first))
+	}
+	if r := first[0]; r.Asn != 4134 || r.City != "Shanghai" || r.DTPR != 0.75 || !r.CFRay || r.Seed != 7 {
+		t.Errorf("record did not survive the CSV round trip: %+v", r)
+	}
+	second, err := LoadResults(shard2)
+	if err != nil {
+		t.Fatalf("LoadResults failed: %v", err)
+	}
+
+	merged := MergeRecords(first, second)
+	var order []string
+	for _, r := range merged {
+		order = append(order, r.IP)
+	}
+	// 104.16.1.2 keeps its newer, faster record; the 2500 KB/s tie goes to the lower delay
+	if got, want := strings.Join(order, " "), "104.16.1.2:443 104.16.1.3:443 104.16.1.1:443"; got != want {
+		t.Errorf("merged order = %s, want %s", got, want)
+	}
+	if merged[0].Seed != 8 {
+		t.Errorf("expected the newest record of a duplicate IP, got %+v", merged[0])
+	}
+	if _, err := LoadResults(filepath.Join(tmpDir, "missing.csv")); err == nil {
+		t.Fatal("expected a missing file to fail")
+	}
+}
+
+func TestQueryRecordsFilters(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "results.db")
+	records := []DBRecord{
+		{TestTimeStr: "2026-10-17 09:00:00", IP: "104.16.1.1:443", Label: "home", DA: 90, DLS: 4000},
+		{TestTimeStr: "2026-10-18 10:00:00", IP: "104.16.1.1:443", Label: "home", DA: 80, DLS: 2500},
+		{TestTimeStr: "2026-10-18 11:00:00", IP: "104.16.1.2:443", Label: "work", DA: 60, DLS: 500},
+		{TestTimeStr: "2026-10-18 12:00:00", IP: "104.16.1.3:443", Label: "home", DA: 70, DLS: 3000},
+	}
+	if err := SaveDBRecords(records, dbPath); err != nil {
+		t.Fatalf("SaveDBRecords failed: %v", err)
+	}
+
+	ips := func(rows []DBRecord) string {
+		var list []string
+		for _, r := range rows {
+			list = append(list, r.TestTimeStr[11:13]+"@"+r.IP)
+		}
+		return strings.Join(list, " ")
+	}
+	for _, tt := range []struct {
+		filter RecordFilter
+		want   string
+	}{
+		{RecordFilter{}, "12@104.16.1.3:443 11@104.16.1.2:443 10@104.16.1.1:443 09@104.16.1.1:443"},
+		{RecordFilter{Limit: 2}, "12@104.16.1.3:443 11@104.16.1.2:443"},
+		{RecordFilter{Label: "home", Since: "2026-10-18"}, "12@104.16.1.3:443 10@104.16.1.1:443"},
+		{RecordFilter{Where: "DLS > 2000", Label: "home"}, "12@104.16.1.3:443 10@104.16.1.1:443 09@104.16.1.1:443"},
+	} {
+		rows, err := QueryRecords(dbPath, tt.filter)
+		if err != nil {
+			t.Fatalf("QueryRecords(%+v) failed: %v", tt.filter, err)
+		}
+		if got := ips(rows); got != tt.want {
+			t.Errorf("QueryRecords(%+v) = %s, want %s", tt.filter, got, tt.want)
+		}
+	}
+
+	// a SQLite file is read by LoadResults as well, so merge accepts it
+	all, err := LoadResults(dbPath)
+	if err != nil {
+		t.Fatalf("LoadResults failed: %v", err)
+	}
+	if got := ips(MergeRecords(all)); got != "12@104.16.1.3:443 10@104.16.1.1:443 11@104.16.1.2:443" {
+		t.Errorf("unexpected ranking %s", got)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, all[:1], true); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	if back, err := ReadCSVResult(&buf); err != nil || len(back) != 1 || back[0].IP != "104.16.1.3:443" {
+		t.Errorf("WriteCSV output did not read back: %+v, %v", back, err)
+	}
+}
@@ -1,52 +1,129 @@
 package db
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"text/tabwriter"
 
 	"cftestor/internal/config"
+	"cftestor/internal/logger"
 	"cftestor/internal/utils"
 )
 
+// WriteCSVResult appends data to the result CSV filePath, creating it with a
+// BOM and header if needed. A file whose header differs, such as one written
+// by an older version with fewer columns, is left alone: rows with a different
+// layout would be misread later. The rows then go to the first "NAME.N.csv"
+// next to it that is free or has the current header.
 func WriteCSVResult(data []DBRecord, filePath string) error {
+	target, err := csvResultTarget(filePath)
+	if err != nil {
+		return err
+	}
+	if target != filePath {
+		logger.Log.Warningf("%q has different CSV columns; writing results to %q instead\n", filePath, target)
+	}
 	var fp *os.File
-	var err error
-	var w *csv.Writer
-	if !utils.FileExists(filePath) {
-		fp, err = os.Create(filePath)
+	newFile := !utils.FileExists(target)
+	if !newFile {
+		header, err := readCSVHeader(target)
 		if err != nil {
-			return fmt.Errorf("failed to create CSV file %q: %w", filePath, err)
+			return err
+		}
+		newFile = header == nil
+	}
+	if newFile {
+		fp, err = os.Create(target)
+		if err != nil {
+			return fmt.Errorf("failed to create CSV file %q: %w", target, err)
 		}
 		wn, wErr := fp.Write(config.UTF8BomBytes)
 		if wErr != nil {
-			return fmt.Errorf("failed to write UTF-8 BOM to CSV file %q: %w", filePath, wErr)
+			_ = fp.Close()
+			return fmt.Errorf("failed to write UTF-8 BOM to CSV file %q: %w", target, wErr)
 		}
 		if wn != len(config.UTF8BomBytes) {
-			return fmt.Errorf("failed to write UTF-8 BOM to CSV file %q: %w", filePath, io.ErrShortWrite)
-		}
-		w = csv.NewWriter(fp)
-		if err = w.Write(config.ResultCsvHeader); err != nil {
-			return fmt.Errorf("failed to write CSV header to %q: %w", filePath, err)
+			_ = fp.Close()
+			return fmt.Errorf("failed to write UTF-8 BOM to CSV file %q: %w", target, io.ErrShortWrite)
 		}
 	} else {
-		fp, err = os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, os.FileMode(0644))
+		fp, err = os.OpenFile(target, os.O_APPEND|os.O_WRONLY, os.FileMode(0644))
 		if err != nil {
-			return fmt.Errorf("failed to open CSV file %q: %w", filePath, err)
+			return fmt.Errorf("failed to open CSV file %q: %w", target, err)
 		}
-		w = csv.NewWriter(fp)
 	}
 	defer func() { _ = fp.Close() }()
+	if err := WriteCSV(fp, data, newFile); err != nil {
+		return fmt.Errorf("failed to write CSV file %q: %w", target, err)
+	}
+	return nil
+}
+
+func csvResultTarget(filePath string) (string, error) {
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filePath, ext)
+	target := filePath
+	for n := 1; ; n++ {
+		if !utils.FileExists(target) {
+			return target, nil
+		}
+		header, err := readCSVHeader(target)
+		if err != nil {
+			return "", err
+		}
+		if header == nil || slices.Equal(header, config.ResultCsvHeader) {
+			return target, nil
+		}
+		target = fmt.Sprintf("%s.%d%s", base, n, ext)
+	}
+}
+
+// readCSVHeader returns the first row of a CSV file, or nil if it is empty.
+func readCSVHeader(filePath string) ([]string, error) {
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV file %q: %w", filePath, err)
+	}
+	defer func() { _ = fp.Close() }()
+	br := bufio.NewReader(fp)
+	if head, err := br.Peek(len(config.UTF8BomBytes)); err == nil && bytes.Equal(head, config.UTF8BomBytes) {
+		_, _ = br.Discard(len(config.UTF8BomBytes))
+	}
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header of CSV file %q: %w", filePath, err)
+	}
+	return header, nil
+}
 
+// WriteCSV writes records in the result CSV layout, preceded by
+// ResultCsvHeader if header is set.
+func WriteCSV(out io.Writer, data []DBRecord, header bool) error {
+	w := csv.NewWriter(out)
+	if header {
+		if err := w.Write(config.ResultCsvHeader); err != nil {
+			return err
+		}
+	}
 	for _, tD := range data {
 		asnStr, city := "", ""
 		if tD.Asn > 0 {
 			asnStr = fmt.Sprintf("AS%v", tD.Asn)
 			city = tD.City
 		}
-		if err = w.Write([]string{
+		if err := w.Write([]string{
 			tD.TestTimeStr,
 			tD.IP,
 			fmt.Sprintf("%.2f", tD.DLS),
@@ -63,15 +140,30 @@ func WriteCSVResult(data []DBRecord, filePath string) error {
 			city,
 			asnStr,
 			tD.Loc,
+			tD.Proto,
+			tD.TLSVersion,
+			tD.Cipher,
+			tD.CertSubject,
+			tD.CertIssuer,
+			tD.CertSANs,
+			tD.SPKI,
+			tD.CertChain,
+			fmt.Sprintf("%t", tD.CertOutlier),
+			fmt.Sprintf("%d", tD.HTTPStatus),
+			fmt.Sprintf("%t", tD.CFRay),
+			tD.Fronting,
+			fmt.Sprintf("%.0f", tD.ProxyAvg),
+			fmt.Sprintf("%.0f", tD.EdgeAvg),
+			tD.SourceAddrs,
+			tD.Origin,
+			fmt.Sprintf("%d", tD.Seed),
+			tD.FailReason,
 		}); err != nil {
-			return fmt.Errorf("failed to write CSV record to %q: %w", filePath, err)
+			return err
 		}
 	}
 	w.Flush()
-	if err := w.Error(); err != nil {
-		return fmt.Errorf("failed to flush CSV file %q: %w", filePath, err)
-	}
-	return nil
+	return w.Error()
 }
 
 func GenDBRecords(verifyResultsSlice []config.VerifyResults, getLocalAsnAndCity bool) (dbRecords []DBRecord) {
@@ -102,6 +194,24 @@ func GenDBRecords(verifyResultsSlice []config.VerifyResults, getLocalAsnAndCity
 			record.DLS = v.Dls
 			record.DLDS = v.Dlds
 			record.DLTD = v.Dltd
+			record.Proto = v.Proto
+			record.TLSVersion = v.Cert.TLSVersion
+			record.Cipher = v.Cert.Cipher
+			record.CertSubject = v.Cert.Subject
+			record.CertIssuer = v.Cert.Issuer
+			record.CertSANs = strings.Join(v.Cert.SANs, ";")
+			record.SPKI = v.Cert.SPKISHA256
+			record.CertChain = v.Cert.ChainSHA256
+			record.CertOutlier = v.CertOutlier
+			record.HTTPStatus = v.StatusCode
+			record.CFRay = v.CFRay
+			record.Fronting = v.Fronting()
+			record.ProxyAvg = v.ProxyAvg
+			record.EdgeAvg = v.EdgeAvg
+			record.SourceAddrs = strings.Join(v.SourceAddrs, ";")
+			record.Origin = v.Origin
+			record.Seed = config.Config.Seed
+			record.FailReason = v.FailReason
 			dbRecords = append(dbRecords, record)
 		}
 	}
@@ -118,7 +228,7 @@ func PrintFinalStat(v []config.VerifyResults, isDtOnly, inSilence bool) {
 		if !isDtOnly {
 			header += "\tSpd(KB/s)\tDLT-T\tDLT-P(%)"
 		}
-		header += "\tDly-Avg(ms)"
+		header += "\tDly-Avg(ms)\tProto\tTLS"
 		if !config.Config.DLTOnly {
 			header += "\tDly-Min(ms)\tDly-Max(ms)\tDT-T\tDT-P(%)"
 			if config.Config.EnableDTEvaluation {
@@ -135,7 +245,14 @@ func PrintFinalStat(v []config.VerifyResults, isDtOnly, inSilence bool) {
 			if !isDtOnly {
 				line += fmt.Sprintf("\t%.0f\t%d\t%.2f", v[i].Dls, v[i].Dltc, v[i].Dltpr*100)
 			}
-			line += fmt.Sprintf("\t%.0f", v[i].Da)
+			tlsMark := "-"
+			if len(v[i].Cert.TLSVersion) > 0 {
+				tlsMark = v[i].Cert.TLSVersion
+			}
+			if v[i].CertOutlier {
+				tlsMark += " OUTLIER"
+			}
+			line += fmt.Sprintf("\t%.0f\t%s\t%s", v[i].Da, v[i].Proto, tlsMark)
 			if !config.Config.DLTOnly {
 				line += fmt.Sprintf("\t%.0f\t%.0f\t%d\t%.2f", v[i].Dmi, v[i].Dmx, v[i].Dtc, v[i].Dtpr*100)
 				if config.Config.EnableDTEvaluation {
@@ -166,8 +283,65 @@ func SaveDBRecords(dbRecords []DBRecord, dbFilePath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to open SQLite database %q: %w", dbFilePath, err)
 	}
+	defer CloseSqlite(db)
 	if err = AddCFDTRecords(db, dbRecords); err != nil {
 		return fmt.Errorf("failed to add CFTD records to SQLite database %q: %w", dbFilePath, err)
 	}
 	return nil
 }
+
+// RecordFilter selects CFTD rows. Where is raw SQL for trusted input such as
+// command-line flags; Label and Since are bound as parameters.
+type RecordFilter struct {
+	Where string
+	Label string
+	// Since keeps rows tested at or after this time, e.g. "2026-10-18" or
+	// "2026-10-18 08:00:00"
+	Since string
+	// Limit caps the number of rows; 0 returns all of them
+	Limit int
+}
+
+// QueryRecords reads the CFTD rows matching filter, newest first.
+func QueryRecords(dbFilePath string, filter RecordFilter) ([]DBRecord, error) {
+	if !utils.FileExists(dbFilePath) {
+		return nil, fmt.Errorf("file %q is not accessible", dbFilePath)
+	}
+	db, err := OpenSqlite(dbFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %q: %w", dbFilePath, err)
+	}
+	defer CloseSqlite(db)
+	tx := db.Model(&DBRecord{})
+	if len(filter.Where) > 0 {
+		tx = tx.Where(filter.Where)
+	}
+	if len(filter.Label) > 0 {
+		tx = tx.Where("LABEL = ?", filter.Label)
+	}
+	if len(filter.Since) > 0 {
+		tx = tx.Where("TestTime >= ?", filter.Since)
+	}
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	var rows []DBRecord
+	if err := tx.Order("TestTime DESC").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to query %s in %q: %w", TableName, dbFilePath, err)
+	}
+	return rows, nil
+}
+
+// LoadInputRecords reads CFTD rows matching query, a SQL WHERE clause, newest
+// first, for --in-db.
+func LoadInputRecords(dbFilePath, query string) ([]config.InputRecord, error) {
+	rows, err := QueryRecords(dbFilePath, RecordFilter{Where: query})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]config.InputRecord, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, config.InputRecord{Host: row.IP, Speed: row.DLS, Delay: row.DA, Colo: row.Loc})
+	}
+	return records, nil
+}
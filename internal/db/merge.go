@@ -0,0 +1,162 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cftestor/internal/config"
+	"cftestor/internal/utils"
+)
+
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// LoadResults reads the records of a result CSV or a SQLite database written
+// by a previous run. The format is told apart by the SQLite file header.
+func LoadResults(filePath string) ([]DBRecord, error) {
+	if !utils.FileExists(filePath) {
+		return nil, fmt.Errorf("file %q is not accessible", filePath)
+	}
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", filePath, err)
+	}
+	defer func() { _ = fp.Close() }()
+	r := bufio.NewReader(fp)
+	if head, _ := r.Peek(len(sqliteMagic)); bytes.Equal(head, sqliteMagic) {
+		return QueryRecords(filePath, RecordFilter{})
+	}
+	records, err := ReadCSVResult(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result CSV %q: %w", filePath, err)
+	}
+	return records, nil
+}
+
+// ReadCSVResult parses a CSV written by WriteCSVResult back into records.
+// Columns are found by header name, so files written by older versions with
+// fewer columns still load; columns the CSV does not carry stay zero.
+func ReadCSVResult(r io.Reader) ([]DBRecord, error) {
+	br := bufio.NewReader(r)
+	if head, err := br.Peek(len(config.UTF8BomBytes)); err == nil && bytes.Equal(head, config.UTF8BomBytes) {
+		_, _ = br.Discard(len(config.UTF8BomBytes))
+	}
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	if _, ok := columns[config.CsvIP]; !ok {
+		return nil, fmt.Errorf("missing IP column")
+	}
+	var records []DBRecord
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+		float := func(name string) float64 {
+			v, _ := strconv.ParseFloat(field(name), 64)
+			return v
+		}
+		integer := func(name string) int {
+			v, _ := strconv.Atoi(field(name))
+			return v
+		}
+		boolean := func(name string) bool {
+			v, _ := strconv.ParseBool(field(name))
+			return v
+		}
+		record := DBRecord{
+			TestTimeStr: field(config.CsvTestTime),
+			IP:          field(config.CsvIP),
+			DLS:         float(config.CsvDLS),
+			DA:          float(config.CsvDA),
+			DS:          field(config.CsvDS),
+			DTPR:        float(config.CsvDTPR) / 100,
+			DTC:         integer(config.CsvDTC),
+			DTPC:        integer(config.CsvDTPC),
+			DMI:         float(config.CsvDMI),
+			DMX:         float(config.CsvDMX),
+			DLTC:        integer(config.CsvDLTC),
+			DLTPC:       integer(config.CsvDLTPC),
+			DLTPR:       float(config.CsvDLPR) / 100,
+			City:        field(config.CsvCity),
+			Loc:         field(config.CsvLoc),
+			Proto:       field(config.CsvProto),
+			TLSVersion:  field(config.CsvTLSV),
+			Cipher:      field(config.CsvCipher),
+			CertSubject: field(config.CsvCSUB),
+			CertIssuer:  field(config.CsvCISS),
+			CertSANs:    field(config.CsvCSAN),
+			SPKI:        field(config.CsvSPKI),
+			CertChain:   field(config.CsvChain),
+			CertOutlier: boolean(config.CsvCOUT),
+			HTTPStatus:  integer(config.CsvHST),
+			CFRay:       boolean(config.CsvRay),
+			Fronting:    field(config.CsvFront),
+			ProxyAvg:    float(config.CsvPXA),
+			EdgeAvg:     float(config.CsvEGA),
+			SourceAddrs: field(config.CsvSRC),
+			Origin:      field(config.CsvOrig),
+			FailReason:  field(config.CsvFail),
+		}
+		record.Asn, _ = strconv.Atoi(strings.TrimPrefix(field(config.CsvASN), "AS"))
+		record.Seed, _ = strconv.ParseInt(field(config.CsvSeed), 10, 64)
+		if record.IP == "" {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// MergeRecords combines the results of several runs, such as the shards of
+// one scan, into one ranked set. An IP tested more than once keeps its most
+// recent record. Records are ranked by download speed, fastest first, then by
+// average delay.
+func MergeRecords(sets ...[]DBRecord) []DBRecord {
+	latest := make(map[string]DBRecord)
+	for _, set := range sets {
+		for _, record := range set {
+			if prev, ok := latest[record.IP]; !ok || record.TestTimeStr > prev.TestTimeStr {
+				latest[record.IP] = record
+			}
+		}
+	}
+	merged := make([]DBRecord, 0, len(latest))
+	for _, record := range latest {
+		merged = append(merged, record)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].DLS != merged[j].DLS {
+			return merged[i].DLS > merged[j].DLS
+		}
+		if merged[i].DA != merged[j].DA {
+			return merged[i].DA < merged[j].DA
+		}
+		return merged[i].IP < merged[j].IP
+	})
+	return merged
+}
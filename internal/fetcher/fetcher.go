@@ -274,6 +274,45 @@ func resolveDomainWithFallback(qname string, qtype uint16, netType, serverAddr s
 	return resolveDomain(qname, qtype, netType, serverAddr)
 }
 
+// ResolveHost looks host up through dnsServerStr, following CNAMEs, and
+// returns its A and/or AAAA addresses in answer order.
+func ResolveHost(dnsServerStr, host string, ipv4, ipv6 bool) ([]net.IP, error) {
+	netType, serverAddr := parseDNSServer(dnsServerStr)
+	var ips []net.IP
+	var lastErr error
+	for _, q := range []struct {
+		enabled bool
+		qtype   uint16
+	}{{ipv4, dns.TypeA}, {ipv6, dns.TypeAAAA}} {
+		if !q.enabled {
+			continue
+		}
+		r, err := resolveDomainWithFallback(host, q.qtype, netType, serverAddr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if r == nil || r.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, ans := range r.Answer {
+			switch rr := ans.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, fmt.Errorf("failed to resolve %q: %w", host, lastErr)
+		}
+		return nil, fmt.Errorf("no address found for %q", host)
+	}
+	return ips, nil
+}
+
 func FetchCloudflareDomains(dnsServerStr string, trancoLimit int) ([]string, error) {
 	bgpPrefixes, err := fetchRawBGPPrefixes()
 	if err != nil {
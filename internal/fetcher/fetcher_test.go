@@ -205,3 +205,56 @@ func TestRipeStatJSONDecoding(t *testing.T) {
 		t.Errorf("prefix 0 mismatch: %s", data.Data.Prefixes[0].Prefix)
 	}
 }
+
+func startTestDNSServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen failed: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func TestResolveHost(t *testing.T) {
+	addr := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Name == "missing.example." {
+			m.Rcode = dns.RcodeNameError
+			w.WriteMsg(m)
+			return
+		}
+		cname, _ := dns.NewRR(q.Name + " 300 IN CNAME edge.example.")
+		m.Answer = append(m.Answer, cname)
+		switch q.Qtype {
+		case dns.TypeA:
+			for _, ip := range []string{"104.16.1.1", "104.16.1.2"} {
+				rr, _ := dns.NewRR("edge.example. 300 IN A " + ip)
+				m.Answer = append(m.Answer, rr)
+			}
+		case dns.TypeAAAA:
+			rr, _ := dns.NewRR("edge.example. 300 IN AAAA 2606:4700::1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+
+	ips, err := ResolveHost(addr, "www.example.com", true, true)
+	if err != nil {
+		t.Fatalf("ResolveHost failed: %v", err)
+	}
+	if len(ips) != 3 || ips[0].String() != "104.16.1.1" || ips[2].String() != "2606:4700::1" {
+		t.Fatalf("unexpected addresses: %v", ips)
+	}
+	ips, err = ResolveHost(addr, "www.example.com", false, true)
+	if err != nil || len(ips) != 1 || ips[0].String() != "2606:4700::1" {
+		t.Fatalf("IPv6-only lookup = %v, %v", ips, err)
+	}
+	if _, err := ResolveHost(addr, "missing.example", true, true); err == nil {
+		t.Fatal("expected NXDOMAIN to fail")
+	}
+}
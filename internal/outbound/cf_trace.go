@@ -2,6 +2,7 @@ package outbound
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +14,7 @@ import (
 	"cftestor/internal/config"
 	"cftestor/internal/logger"
 	"cftestor/internal/utils"
+	utls "github.com/refraction-networking/utls"
 )
 
 // GetGeoInfoFromCF gets loc from https://<cloudflared_url>/cdn-cgi/trace
@@ -54,7 +56,8 @@ func GetGeoInfoFromCF(ipStr *string) (loc string) {
 	fullAddress := net.JoinHostPort(t_ip, fmt.Sprint(t_port))
 	var client = http.Client{
 		Transport: &http.Transport{
-			DialContext: GetDialContextByAddr(fullAddress),
+			DialContext:    GetDialContextByAddr(fullAddress),
+			DialTLSContext: getTraceDialTLSContext(fullAddress, t_url.Hostname()),
 		},
 		CheckRedirect: nil,
 		Jar:           nil,
@@ -75,6 +78,27 @@ func GetGeoInfoFromCF(ipStr *string) (loc string) {
 	return
 }
 
+// getTraceDialTLSContext sends the trace with the same ClientHello as the
+// probes. ALPN is pinned to http/1.1 because the transport speaks HTTP/1.1 only.
+func getTraceDialTLSContext(addrPort, serverName string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := OutboundDialContext(ctx, network, addrPort)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn, err := NewUClient(conn, &utls.Config{ServerName: serverName}, config.Config.TLSClientID, []string{"http/1.1"})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
 func getCFCDNCgiTraceUrl() (baseurl string) {
 	t_cf_url, t_err := url.Parse(config.BaseCfCDNCgiTraceUrl)
 	if t_err != nil {
@@ -20,6 +20,18 @@ func PrepareOutboundOptions(opts *config.CliOptions) error {
 			return err
 		}
 	}
+	if err := prepareHelloSpec(); err != nil {
+		return err
+	}
+	if err := prepareSourceIPs(); err != nil {
+		return err
+	}
+	if err := prepareProxy(); err != nil {
+		return err
+	}
+	if err := prepareOutboundPaths(opts); err != nil {
+		return err
+	}
 	return validateOutboundPlatformOptions()
 }
 
@@ -71,7 +83,7 @@ func PrepareOutboundInterface() error {
 		return nil
 	}
 	if ip, zone, ok := parseOutboundSourceIP(raw); ok {
-		if err := validateLocalSourceIP(ip, zone); err != nil {
+		if err := validateLocalSourceIP("--interface", ip, zone); err != nil {
 			return err
 		}
 		config.Config.OutboundSourceIP = ip
@@ -143,13 +155,13 @@ func allDecimalDigits(value string) bool {
 	return true
 }
 
-func validateLocalSourceIP(ip net.IP, zone string) error {
+func validateLocalSourceIP(flagName string, ip net.IP, zone string) error {
 	if ip == nil || ip.IsUnspecified() {
-		return fmt.Errorf("invalid value for %q: source IP must be assigned to a local interface", "--interface")
+		return fmt.Errorf("invalid value for %q: source IP must be assigned to a local interface", flagName)
 	}
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return fmt.Errorf("failed to list local interfaces for %q validation: %w", "--interface", err)
+		return fmt.Errorf("failed to list local interfaces for %q validation: %w", flagName, err)
 	}
 	for _, iface := range ifaces {
 		if !interfaceMatchesZone(iface, zone) {
@@ -167,9 +179,9 @@ func validateLocalSourceIP(ip net.IP, zone string) error {
 		}
 	}
 	if zone != "" {
-		return fmt.Errorf("invalid value for %q: source IP %s%%%s is not assigned to a local interface", "--interface", ip, zone)
+		return fmt.Errorf("invalid value for %q: source IP %s%%%s is not assigned to a local interface", flagName, ip, zone)
 	}
-	return fmt.Errorf("invalid value for %q: source IP %s is not assigned to a local interface", "--interface", ip)
+	return fmt.Errorf("invalid value for %q: source IP %s is not assigned to a local interface", flagName, ip)
 }
 
 func interfaceMatchesZone(iface net.Interface, zone string) bool {
@@ -180,9 +192,19 @@ func interfaceMatchesZone(iface net.Interface, zone string) bool {
 }
 
 func OutboundDialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if config.Config.ProxyURL != nil {
+		return dialViaProxy(ctx, network, address)
+	}
+	return dialDirect(ctx, network, address)
+}
+
+func dialDirect(ctx context.Context, network, address string) (net.Conn, error) {
 	if config.Config.OutboundInterfaceIndex > 0 && outboundInterfaceUsesSourceFallback() {
 		return dialWithInterfaceSourceFallback(ctx, network, address)
 	}
+	if outboundSources != nil {
+		return dialWithSourcePool(ctx, network, address)
+	}
 	dialer, err := newOutboundDialer(network, nil, "")
 	if err != nil {
 		return nil, err
@@ -297,7 +319,7 @@ func resolveOutboundDialTargets(ctx context.Context, network, address string) ([
 	}
 	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve %q for %q interface fallback: %w", host, "--interface", err)
+		return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
 	}
 	targets := make([]outboundDialTarget, 0, len(ips))
 	for _, ipAddr := range ips {
@@ -1,9 +1,24 @@
 package outbound
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"cftestor/internal/config"
+	utls "github.com/refraction-networking/utls"
 )
 
 func TestParseOutboundMark(t *testing.T) {
@@ -122,3 +137,354 @@ kex=X25519
 		t.Fatalf("expected non-empty location from trace")
 	}
 }
+
+func TestSetALPNRewritesFingerprintSpec(t *testing.T) {
+	spec, err := utls.UTLSIdToSpec(utls.HelloChrome_Auto)
+	if err != nil {
+		t.Fatalf("UTLSIdToSpec failed: %v", err)
+	}
+	setALPN(&spec, []string{"http/1.1"})
+	found := 0
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			found++
+			if len(alpn.AlpnProtocols) != 1 || alpn.AlpnProtocols[0] != "http/1.1" {
+				t.Errorf("ALPN protocols = %v, want [http/1.1]", alpn.AlpnProtocols)
+			}
+		}
+	}
+	if found != 1 {
+		t.Fatalf("expected exactly one ALPN extension, found %d", found)
+	}
+
+	spec = utls.ClientHelloSpec{Extensions: []utls.TLSExtension{&utls.SNIExtension{}, &utls.UtlsPaddingExtension{}}}
+	setALPN(&spec, []string{"h2"})
+	if len(spec.Extensions) != 3 {
+		t.Fatalf("expected ALPN to be added, got %d extensions", len(spec.Extensions))
+	}
+	if _, ok := spec.Extensions[2].(*utls.UtlsPaddingExtension); !ok {
+		t.Errorf("padding extension should stay last, got %T", spec.Extensions[2])
+	}
+}
+
+func TestLoadHelloSpecFromHexDump(t *testing.T) {
+	uconn := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_Auto)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatalf("BuildHandshakeState failed: %v", err)
+	}
+	// bare handshake message, formatted like a Wireshark hex copy
+	dump := ""
+	for i, b := range uconn.HandshakeState.Hello.Raw {
+		if i > 0 && i%16 == 0 {
+			dump += "\n"
+		}
+		dump += hex.EncodeToString([]byte{b}) + " "
+	}
+	path := filepath.Join(t.TempDir(), "hello.hex")
+	if err := os.WriteFile(path, []byte(dump), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadHelloSpec(path); err != nil {
+		t.Fatalf("LoadHelloSpec failed: %v", err)
+	}
+	tlsConn, err := NewUClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloCustom, []string{"http/1.1"})
+	if err != nil {
+		t.Fatalf("NewUClient failed: %v", err)
+	}
+	if err := tlsConn.BuildHandshakeState(); err != nil {
+		t.Fatalf("BuildHandshakeState with loaded spec failed: %v", err)
+	}
+	if protos := tlsConn.HandshakeState.Hello.AlpnProtocols; len(protos) != 1 || protos[0] != "http/1.1" {
+		t.Errorf("ALPN = %v, want [http/1.1]", protos)
+	}
+}
+
+func TestLoadHelloSpecFromJSON(t *testing.T) {
+	spec := `{
+	"cipher_suites": ["TLS_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"],
+	"compression_methods": ["NULL"],
+	"extensions": [
+		{"name": "server_name"},
+		{"name": "supported_groups", "named_group_list": ["x25519", "secp256r1"]},
+		{"name": "signature_algorithms", "supported_signature_algorithms": ["ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256", "rsa_pkcs1_sha256"]},
+		{"name": "key_share", "client_shares": [{"group": "x25519", "key_exchange": []}]},
+		{"name": "supported_versions", "versions": ["TLS 1.3", "TLS 1.2"]}
+	]
+}`
+	path := filepath.Join(t.TempDir(), "hello.json")
+	if err := os.WriteFile(path, []byte(spec), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadHelloSpec(path); err != nil {
+		t.Fatalf("LoadHelloSpec failed: %v", err)
+	}
+	tlsConn, err := NewUClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloCustom, nil)
+	if err != nil {
+		t.Fatalf("NewUClient failed: %v", err)
+	}
+	if err := tlsConn.BuildHandshakeState(); err != nil {
+		t.Fatalf("BuildHandshakeState with loaded spec failed: %v", err)
+	}
+	if got := len(tlsConn.HandshakeState.Hello.CipherSuites); got != 2 {
+		t.Errorf("cipher suites = %d, want 2", got)
+	}
+}
+
+func TestLoadHelloSpecRejectsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("not a client hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadHelloSpec(path); err == nil {
+		t.Fatal("expected an error for an invalid spec file")
+	}
+}
+
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startProxyServer(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) (string, error)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				target, err := handshake(conn, r)
+				if err != nil {
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() { _, _ = io.Copy(upstream, r) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func httpConnectHandshake(conn net.Conn, r *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return "", io.EOF
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return req.Host, err
+}
+
+func socks5Handshake(conn net.Conn, r *bufio.Reader) (string, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, make([]byte, greeting[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil || head[3] != 1 {
+		return "", io.EOF
+	}
+	addr := make([]byte, 6)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(net.IP(addr[:4]).String(), strconv.Itoa(int(addr[4])<<8|int(addr[5]))), nil
+}
+
+func TestOutboundDialContextThroughProxy(t *testing.T) {
+	target := startEchoServer(t)
+	tests := []struct {
+		name      string
+		proxyURL  string
+		handshake func(net.Conn, *bufio.Reader) (string, error)
+	}{
+		{"http", "http://user:pass@%s", httpConnectHandshake},
+		{"socks5", "socks5://%s", socks5Handshake},
+	}
+	defer func() { config.Config = config.DefaultConfig() }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config = config.DefaultConfig()
+			config.Config.Proxy = fmt.Sprintf(tt.proxyURL, startProxyServer(t, tt.handshake))
+			if err := prepareProxy(); err != nil {
+				t.Fatalf("prepareProxy failed: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := OutboundDialContext(ctx, "tcp", target)
+			if err != nil {
+				t.Fatalf("dial through proxy failed: %v", err)
+			}
+			defer conn.Close()
+			if _, _, ok := ProxyTimings(conn); !ok {
+				t.Fatal("expected proxy timings on a proxied connection")
+			}
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("echo through proxy = %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestPrepareProxyRejectsUnsupportedScheme(t *testing.T) {
+	defer func() { config.Config = config.DefaultConfig() }()
+	for _, raw := range []string{"ftp://proxy:21", "socks5://", "://bad"} {
+		config.Config.Proxy = raw
+		if err := prepareProxy(); err == nil {
+			t.Errorf("expected an error for %q", raw)
+		}
+	}
+	config.Config.Proxy = "socks5://127.0.0.1"
+	if err := prepareProxy(); err != nil || config.Config.ProxyURL.Port() != "1080" {
+		t.Fatalf("default socks5 port: %v, %v", config.Config.ProxyURL, err)
+	}
+}
+
+func TestPrepareOutboundPaths(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skip("no local interfaces")
+	}
+	defer func() { config.Config = config.DefaultConfig(); outboundPaths = nil }()
+	config.Config = config.DefaultConfig()
+	config.Config.ViaInterfaces = []string{ifaces[0].Name, ifaces[0].Name}
+	config.Config.ViaMarks = []string{"0x1", "2"}
+	err = prepareOutboundPaths(&config.CliOptions{})
+	if runtime.GOOS != "linux" {
+		if err == nil {
+			t.Fatal("expected --via-marks to be rejected outside Linux")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("prepareOutboundPaths failed: %v", err)
+	}
+	paths := OutboundPaths()
+	if len(paths) != 3 || paths[0].Name != ifaces[0].Name || paths[1].Name != "mark:0x1" || paths[2].Name != "mark:0x2" {
+		t.Fatalf("unexpected paths: %+v", paths)
+	}
+	if config.Config.OutboundMarkSet || config.Config.OutboundInterfaceIndex != 0 {
+		t.Fatal("preparing paths must leave the base outbound options untouched")
+	}
+
+	restore := paths[2].Apply()
+	if !config.Config.OutboundMarkSet || config.Config.OutboundMark != 2 {
+		t.Fatalf("Apply did not set the mark: %+v", config.Config.OutboundMark)
+	}
+	restore()
+	if config.Config.OutboundMarkSet {
+		t.Fatal("restore did not clear the mark")
+	}
+
+	config.Config.ViaMarks = []string{"0x1"}
+	if err := prepareOutboundPaths(&config.CliOptions{MarkChanged: true}); err == nil {
+		t.Fatal("expected --via-marks with --mark to be rejected")
+	}
+}
+
+func TestSourcePoolRoundRobin(t *testing.T) {
+	pool := &sourcePool{
+		v4: []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}, {IP: net.ParseIP("192.0.2.2").To4()}},
+		v6: []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}},
+	}
+	got := make([]string, 0, 3)
+	for range 3 {
+		addr, ok := pool.next("tcp4")
+		if !ok {
+			t.Fatal("expected an IPv4 source")
+		}
+		got = append(got, addr.IP.String())
+	}
+	if strings.Join(got, ",") != "192.0.2.1,192.0.2.2,192.0.2.1" {
+		t.Fatalf("unexpected rotation: %v", got)
+	}
+	if addr, ok := pool.next("tcp6"); !ok || addr.IP.String() != "2001:db8::1" {
+		t.Fatalf("unexpected IPv6 source: %v %v", addr, ok)
+	}
+	if _, ok := (&sourcePool{v6: pool.v6}).next("tcp4"); ok {
+		t.Fatal("expected no IPv4 source in an IPv6-only pool")
+	}
+}
+
+func TestSourceIPsDial(t *testing.T) {
+	defer func() { config.Config = config.DefaultConfig(); outboundSources = nil }()
+	config.Config = config.DefaultConfig()
+	config.Config.SourceIPs = []string{"127.0.0.1"}
+	if err := prepareSourceIPs(); err != nil {
+		t.Skipf("loopback source unavailable: %v", err)
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := OutboundDialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	if got := SourceAddr(conn); got != "127.0.0.1" {
+		t.Fatalf("SourceAddr = %q", got)
+	}
+
+	config.Config.SourceIPs = []string{"192.0.2.250"}
+	if err := prepareSourceIPs(); err == nil {
+		t.Fatal("expected a non-local source IP to be rejected")
+	}
+	config.Config.SourceIPs = []string{"127.0.0.1"}
+	config.Config.OutboundInterface = "lo"
+	if err := prepareSourceIPs(); err == nil {
+		t.Fatal("expected --source-ips with --interface to be rejected")
+	}
+}
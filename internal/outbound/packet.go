@@ -0,0 +1,53 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"cftestor/internal/config"
+)
+
+// OutboundListenPacket opens the UDP socket of a QUIC probe to remote with the
+// same mark, interface and source address options as TCP dials. --proxy cannot
+// carry UDP, so QUIC probes always leave directly.
+func OutboundListenPacket(ctx context.Context, remote *net.UDPAddr) (net.PacketConn, error) {
+	if config.Config.ProxyURL != nil {
+		return nil, fmt.Errorf("%q cannot carry QUIC (UDP) probes", "--proxy")
+	}
+	network := "udp6"
+	if remote.IP.To4() != nil {
+		network = "udp4"
+	}
+	sourceIP, zone := config.Config.OutboundSourceIP, config.Config.OutboundSourceZone
+	switch {
+	case config.Config.OutboundInterfaceIndex > 0 && outboundInterfaceUsesSourceFallback():
+		ip, ipZone, err := sourceIPFromInterface(network)
+		if err != nil {
+			return nil, err
+		}
+		sourceIP, zone = ip, ipZone
+	case outboundSources != nil:
+		source, ok := outboundSources.next(network)
+		if !ok {
+			return nil, fmt.Errorf("no %q address for %s", "--source-ips", remote)
+		}
+		sourceIP, zone = source.IP, source.Zone
+	}
+	local := &net.UDPAddr{}
+	if sourceIP != nil {
+		ip, err := sourceIPForNetwork(network, sourceIP)
+		if err != nil {
+			return nil, err
+		}
+		local.IP, local.Zone = ip, zone
+	}
+	lc := net.ListenConfig{}
+	if needsOutboundSocketControl() {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return applyOutboundSocketOptions(network, address, c)
+		}
+	}
+	return lc.ListenPacket(ctx, network, local.String())
+}
@@ -0,0 +1,113 @@
+package outbound
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"cftestor/internal/config"
+)
+
+// OutboundPath is one uplink from --via-interfaces or --via-marks, kept as a
+// snapshot of the outbound socket options.
+type OutboundPath struct {
+	Name       string
+	mark       uint32
+	markSet    bool
+	iface      string
+	ifaceName  string
+	ifaceIndex int
+	sourceIP   net.IP
+	sourceZone string
+}
+
+var outboundPaths []OutboundPath
+
+// OutboundPaths returns the paths prepared by PrepareOutboundOptions.
+func OutboundPaths() []OutboundPath {
+	return outboundPaths
+}
+
+func snapshotOutboundPath(name string) OutboundPath {
+	c := &config.Config
+	return OutboundPath{
+		Name:       name,
+		mark:       c.OutboundMark,
+		markSet:    c.OutboundMarkSet,
+		iface:      c.OutboundInterface,
+		ifaceName:  c.OutboundInterfaceName,
+		ifaceIndex: c.OutboundInterfaceIndex,
+		sourceIP:   c.OutboundSourceIP,
+		sourceZone: c.OutboundSourceZone,
+	}
+}
+
+func (p OutboundPath) load() {
+	c := &config.Config
+	c.OutboundMark, c.OutboundMarkSet = p.mark, p.markSet
+	c.OutboundInterface, c.OutboundInterfaceName, c.OutboundInterfaceIndex = p.iface, p.ifaceName, p.ifaceIndex
+	c.OutboundSourceIP, c.OutboundSourceZone = p.sourceIP, p.sourceZone
+}
+
+// Apply switches outbound dials to this path and returns a function that
+// restores the previous options.
+func (p OutboundPath) Apply() (restore func()) {
+	prev := snapshotOutboundPath("")
+	p.load()
+	return prev.load
+}
+
+// prepareOutboundPaths validates every --via-interfaces / --via-marks entry.
+// Paths are a union: one per interface and one per mark, each on top of the
+// other outbound options.
+func prepareOutboundPaths(opts *config.CliOptions) error {
+	outboundPaths = nil
+	if len(config.Config.ViaInterfaces) == 0 && len(config.Config.ViaMarks) == 0 {
+		return nil
+	}
+	if len(config.Config.ViaInterfaces) > 0 && len(config.Config.OutboundInterface) > 0 {
+		return fmt.Errorf("%q and %q cannot be provided at the same time", "--via-interfaces", "--interface")
+	}
+	if len(config.Config.ViaMarks) > 0 && (opts.MarkChanged || opts.XMarkChanged) {
+		return fmt.Errorf("%q and %q cannot be provided at the same time", "--via-marks", "--mark")
+	}
+	base := snapshotOutboundPath("")
+	defer base.load()
+	seen := make(map[string]bool)
+	paths := make([]OutboundPath, 0, len(config.Config.ViaInterfaces)+len(config.Config.ViaMarks))
+	for _, raw := range config.Config.ViaInterfaces {
+		name := strings.TrimSpace(raw)
+		if name == "" || seen["if:"+name] {
+			continue
+		}
+		seen["if:"+name] = true
+		base.load()
+		config.Config.OutboundInterface = name
+		if err := PrepareOutboundInterface(); err != nil {
+			return fmt.Errorf("%q entry %q: %w", "--via-interfaces", name, err)
+		}
+		paths = append(paths, snapshotOutboundPath(name))
+	}
+	for _, raw := range config.Config.ViaMarks {
+		mark, err := ParseOutboundMark("--via-marks", raw)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("mark:0x%x", mark)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		base.load()
+		config.Config.OutboundMark, config.Config.OutboundMarkSet = mark, true
+		if err := validateOutboundPlatformOptions(); err != nil {
+			return fmt.Errorf("%q: %w", "--via-marks", err)
+		}
+		paths = append(paths, snapshotOutboundPath(name))
+	}
+	if len(paths) < 2 {
+		return fmt.Errorf("at least two outbound paths are needed for %q / %q", "--via-interfaces", "--via-marks")
+	}
+	outboundPaths = paths
+	return nil
+}
@@ -0,0 +1,156 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cftestor/internal/config"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyConn is a tunnel opened through --proxy. ProxyLeg is the time to reach
+// the proxy itself, EdgeLeg the time the proxy took to connect to the target.
+type ProxyConn struct {
+	net.Conn
+	ProxyLeg time.Duration
+	EdgeLeg  time.Duration
+	reader   *bufio.Reader
+}
+
+func (c *ProxyConn) Read(p []byte) (int, error) {
+	if c.reader != nil {
+		if c.reader.Buffered() > 0 {
+			return c.reader.Read(p)
+		}
+		c.reader = nil
+	}
+	return c.Conn.Read(p)
+}
+
+// ProxyTimings returns the proxy and edge legs of a connection dialed through
+// --proxy. ok is false for direct connections.
+func ProxyTimings(conn net.Conn) (proxyLeg, edgeLeg time.Duration, ok bool) {
+	pc, ok := conn.(*ProxyConn)
+	if !ok {
+		return 0, 0, false
+	}
+	return pc.ProxyLeg, pc.EdgeLeg, true
+}
+
+func prepareProxy() error {
+	raw := strings.TrimSpace(config.Config.Proxy)
+	if raw == "" {
+		config.Config.ProxyURL = nil
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid value for %q: %w", "--proxy", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return fmt.Errorf("invalid value for %q: unsupported scheme %q; use socks5:// or http://", "--proxy", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid value for %q: missing proxy host", "--proxy")
+	}
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "8080"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	config.Config.ProxyURL = u
+	return nil
+}
+
+// timedForward dials the proxy with the outbound socket options and records
+// how long that took.
+type timedForward struct {
+	took time.Duration
+}
+
+func (f *timedForward) Dial(network, address string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, address)
+}
+
+func (f *timedForward) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := dialDirect(ctx, network, address)
+	f.took = time.Since(start)
+	return conn, err
+}
+
+func dialViaProxy(ctx context.Context, network, address string) (net.Conn, error) {
+	u := config.Config.ProxyURL
+	start := time.Now()
+	forward := &timedForward{}
+	var conn net.Conn
+	var reader *bufio.Reader
+	var err error
+	switch u.Scheme {
+	case "http":
+		conn, reader, err = dialHTTPConnect(ctx, forward, u, network, address)
+	default:
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		var dialer proxy.Dialer
+		dialer, err = proxy.SOCKS5("tcp", u.Host, auth, forward)
+		if err == nil {
+			conn, err = dialer.(proxy.ContextDialer).DialContext(ctx, network, address)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", u.Redacted(), err)
+	}
+	return &ProxyConn{Conn: conn, ProxyLeg: forward.took, EdgeLeg: time.Since(start) - forward.took, reader: reader}, nil
+}
+
+func dialHTTPConnect(ctx context.Context, forward *timedForward, u *url.URL, network, address string) (net.Conn, *bufio.Reader, error) {
+	conn, err := forward.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+	return conn, reader, nil
+}
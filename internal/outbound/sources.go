@@ -0,0 +1,164 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"cftestor/internal/config"
+)
+
+// sourcePool holds the --source-ips addresses per family. Dials take them in
+// turn, so consecutive connections leave from different local addresses.
+type sourcePool struct {
+	v4, v6 []net.IPAddr
+	n4, n6 atomic.Uint64
+}
+
+var outboundSources *sourcePool
+
+// SourcePoolActive reports whether --source-ips is in use.
+func SourcePoolActive() bool {
+	return outboundSources != nil
+}
+
+// SourceAddr returns the local IP a TCP connection or a QUIC socket was
+// dialed from.
+func SourceAddr(conn interface{ LocalAddr() net.Addr }) string {
+	if conn == nil {
+		return ""
+	}
+	switch addr := conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
+
+func prepareSourceIPs() error {
+	outboundSources = nil
+	if len(config.Config.SourceIPs) == 0 {
+		return nil
+	}
+	if len(config.Config.OutboundInterface) > 0 {
+		return fmt.Errorf("%q and %q cannot be provided at the same time", "--source-ips", "--interface")
+	}
+	if len(config.Config.ViaInterfaces) > 0 {
+		return fmt.Errorf("%q and %q cannot be provided at the same time", "--source-ips", "--via-interfaces")
+	}
+	pool := &sourcePool{}
+	seen := make(map[string]bool)
+	add := func(ip net.IP, zone string) {
+		key := ip.String() + "%" + zone
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if ip.To4() != nil {
+			pool.v4 = append(pool.v4, net.IPAddr{IP: ip.To4()})
+		} else {
+			pool.v6 = append(pool.v6, net.IPAddr{IP: ip, Zone: zone})
+		}
+	}
+	for _, raw := range config.Config.SourceIPs {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if ip, zone, ok := parseOutboundSourceIP(raw); ok {
+			if err := validateLocalSourceIP("--source-ips", ip, zone); err != nil {
+				return err
+			}
+			add(ip, zone)
+			continue
+		}
+		ips, err := interfaceSourceIPs(raw)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			add(ip, "")
+		}
+	}
+	if len(pool.v4)+len(pool.v6) == 0 {
+		return fmt.Errorf("invalid value for %q: no usable source address", "--source-ips")
+	}
+	outboundSources = pool
+	return nil
+}
+
+// interfaceSourceIPs expands an interface name to its routable addresses.
+// Link-local addresses are skipped since they cannot reach the edge.
+func interfaceSourceIPs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %q: %q is neither an IP nor an interface", "--source-ips", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses for interface %q: %w", iface.Name, err)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := normalizeOutboundIP(ipFromAddr(addr))
+		if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("invalid value for %q: interface %q has no usable address", "--source-ips", iface.Name)
+	}
+	return ips, nil
+}
+
+// next returns the next source address for network, which must name a family.
+func (p *sourcePool) next(network string) (net.IPAddr, bool) {
+	var list []net.IPAddr
+	var counter *atomic.Uint64
+	switch networkAddressFamily(network) {
+	case 4:
+		list, counter = p.v4, &p.n4
+	case 6:
+		list, counter = p.v6, &p.n6
+	default:
+		return net.IPAddr{}, false
+	}
+	if len(list) == 0 {
+		return net.IPAddr{}, false
+	}
+	return list[(counter.Add(1)-1)%uint64(len(list))], true
+}
+
+func dialWithSourcePool(ctx context.Context, network, address string) (net.Conn, error) {
+	targets, err := resolveOutboundDialTargets(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, target := range targets {
+		source, ok := outboundSources.next(target.network)
+		if !ok {
+			lastErr = fmt.Errorf("no %q address for %s", "--source-ips", target.address)
+			continue
+		}
+		dialer, err := newOutboundDialer(target.network, source.IP, source.Zone)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, target.network, target.address)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no usable dial targets for %q", address)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,146 @@
+package outbound
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"cftestor/internal/config"
+	utls "github.com/refraction-networking/utls"
+)
+
+var (
+	helloSpecMu   sync.RWMutex
+	helloSpecData []byte
+	helloSpecRaw  bool
+)
+
+// LoadHelloSpec reads a ClientHello description for --hello-spec. The file is
+// either a JSON ClientHelloSpec or a hex dump of a captured ClientHello.
+func LoadHelloSpec(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %q file %q: %w", "--hello-spec", path, err)
+	}
+	raw := false
+	trimmed := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(trimmed, "{") {
+		data, err = decodeHelloHex(trimmed)
+		if err != nil {
+			return fmt.Errorf("invalid %q file %q: %w", "--hello-spec", path, err)
+		}
+		raw = true
+	}
+	if _, err := parseHelloSpec(data, raw); err != nil {
+		return fmt.Errorf("invalid %q file %q: %w", "--hello-spec", path, err)
+	}
+	helloSpecMu.Lock()
+	helloSpecData, helloSpecRaw = data, raw
+	helloSpecMu.Unlock()
+	return nil
+}
+
+func decodeHelloHex(dump string) ([]byte, error) {
+	cleaned := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', ':', ',':
+			return -1
+		}
+		return r
+	}, dump)
+	cleaned = strings.ReplaceAll(strings.ReplaceAll(cleaned, "0x", ""), "0X", "")
+	data, err := hex.DecodeString(cleaned)
+	if err != nil {
+		return nil, fmt.Errorf("not JSON and not a hex ClientHello dump: %w", err)
+	}
+	if len(data) > 0 && data[0] == 0x01 {
+		// bare handshake message, add the TLS record header FromRaw expects
+		data = append([]byte{0x16, 0x03, 0x01, byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	return data, nil
+}
+
+func parseHelloSpec(data []byte, raw bool) (*utls.ClientHelloSpec, error) {
+	f := &utls.Fingerprinter{AllowBluntMimicry: true}
+	if raw {
+		return f.RawClientHello(data)
+	}
+	return f.UnmarshalJSONClientHello(data)
+}
+
+// customHelloSpec returns a fresh spec for every connection, since extensions
+// keep per-handshake state and must not be shared.
+func customHelloSpec() (*utls.ClientHelloSpec, error) {
+	helloSpecMu.RLock()
+	data, raw := helloSpecData, helloSpecRaw
+	helloSpecMu.RUnlock()
+	if data == nil {
+		return nil, fmt.Errorf("no ClientHello spec loaded for %q", "--hello-spec")
+	}
+	return parseHelloSpec(data, raw)
+}
+
+// NewUClient builds a uTLS client for helloID. utls.HelloCustom selects the
+// spec loaded by --hello-spec. A non-nil alpn replaces only the ALPN
+// extension, so the rest of the ClientHello stays identical.
+func NewUClient(conn net.Conn, conf *utls.Config, helloID utls.ClientHelloID, alpn []string) (*utls.UConn, error) {
+	var spec *utls.ClientHelloSpec
+	if helloID == utls.HelloCustom {
+		s, err := customHelloSpec()
+		if err != nil {
+			return nil, err
+		}
+		spec = s
+	} else if alpn != nil {
+		s, err := utls.UTLSIdToSpec(helloID)
+		if err != nil {
+			// randomized fingerprints have no static spec to rewrite
+			return nil, fmt.Errorf("%q cannot rewrite the ALPN of fingerprint %s: %w", "--http-version", helloID.Str(), err)
+		}
+		spec = &s
+	}
+	if spec == nil {
+		return utls.UClient(conn, conf, helloID), nil
+	}
+	if alpn != nil {
+		setALPN(spec, alpn)
+	}
+	tlsConn := utls.UClient(conn, conf, utls.HelloCustom)
+	if err := tlsConn.ApplyPreset(spec); err != nil {
+		return nil, fmt.Errorf("apply ClientHello spec: %w", err)
+	}
+	return tlsConn, nil
+}
+
+func setALPN(spec *utls.ClientHelloSpec, protocols []string) {
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = protocols
+			return
+		}
+	}
+	// keep padding as the trailing extension when adding ALPN
+	alpn := &utls.ALPNExtension{AlpnProtocols: protocols}
+	for i, ext := range spec.Extensions {
+		if _, ok := ext.(*utls.UtlsPaddingExtension); ok {
+			spec.Extensions = append(spec.Extensions[:i], append([]utls.TLSExtension{alpn}, spec.Extensions[i:]...)...)
+			return
+		}
+	}
+	spec.Extensions = append(spec.Extensions, alpn)
+}
+
+func prepareHelloSpec() error {
+	path := strings.TrimSpace(config.Config.TLSHelloSpecFile)
+	if path == "" {
+		return nil
+	}
+	if err := LoadHelloSpec(path); err != nil {
+		return err
+	}
+	config.Config.TLSClientID = utls.HelloCustom
+	return nil
+}
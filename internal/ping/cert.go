@@ -0,0 +1,71 @@
+package ping
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"cftestor/internal/config"
+	utls "github.com/refraction-networking/utls"
+)
+
+func certInfoFromState(state utls.ConnectionState) config.CertInfo {
+	return certInfo(state.Version, state.CipherSuite, state.PeerCertificates)
+}
+
+// certInfoFromQUIC reads the TLS state of a QUIC connection, which uses
+// crypto/tls rather than uTLS.
+func certInfoFromQUIC(state tls.ConnectionState) config.CertInfo {
+	return certInfo(state.Version, state.CipherSuite, state.PeerCertificates)
+}
+
+func certInfo(version, cipherSuite uint16, peerCertificates []*x509.Certificate) config.CertInfo {
+	info := config.CertInfo{}
+	if version == 0 {
+		return info
+	}
+	info.TLSVersion = utls.VersionName(version)
+	info.Cipher = utls.CipherSuiteName(cipherSuite)
+	if len(peerCertificates) == 0 {
+		return info
+	}
+	leaf := peerCertificates[0]
+	info.Subject = leaf.Subject.String()
+	info.Issuer = leaf.Issuer.String()
+	info.SANs = append(info.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	info.SPKISHA256 = base64.StdEncoding.EncodeToString(spki[:])
+	chain := sha256.New()
+	for _, cert := range peerCertificates {
+		chain.Write(cert.Raw)
+	}
+	info.ChainSHA256 = hex.EncodeToString(chain.Sum(nil))
+	return info
+}
+
+// certMismatch applies --pin-spki and --expect-issuer to a probe's
+// certificate and returns why it was rejected, or "" when it is accepted.
+func certMismatch(info config.CertInfo) string {
+	if len(config.Config.PinSPKI) > 0 && !slices.Contains(config.Config.PinSPKI, info.SPKISHA256) {
+		return fmt.Sprintf("SPKI %s does not match --pin-spki", info.SPKISHA256)
+	}
+	if len(config.Config.ExpectIssuer) > 0 &&
+		!strings.Contains(strings.ToLower(info.Issuer), strings.ToLower(config.Config.ExpectIssuer)) {
+		return fmt.Sprintf("issuer %q does not match --expect-issuer", info.Issuer)
+	}
+	return ""
+}
+
+// certChecked reports whether --pin-spki or --expect-issuer is set, so a
+// probe without TLS must fail instead of passing unchecked.
+func certChecked() bool {
+	return len(config.Config.PinSPKI) > 0 || len(config.Config.ExpectIssuer) > 0
+}
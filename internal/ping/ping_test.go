@@ -1,11 +1,26 @@
 package ping
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"cftestor/internal/config"
+	"github.com/quic-go/quic-go/http3"
 	utls "github.com/refraction-networking/utls"
 )
 
@@ -68,3 +83,206 @@ func TestUTLSTransportHTTPRouting(t *testing.T) {
 	// Should route via tr1
 	_, _ = tr.RoundTrip(httpReq)
 }
+
+func TestCertInfoAndPinning(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		Issuer:       pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := certInfoFromState(utls.ConnectionState{
+		Version:          utls.VersionTLS13,
+		CipherSuite:      utls.TLS_AES_128_GCM_SHA256,
+		PeerCertificates: []*x509.Certificate{cert},
+	})
+	if info.TLSVersion != "TLS 1.3" || info.Cipher != "TLS_AES_128_GCM_SHA256" {
+		t.Fatalf("unexpected session info: %+v", info)
+	}
+	if info.Subject != "CN=example.com" || len(info.SANs) != 2 || len(info.ChainSHA256) != 64 {
+		t.Fatalf("unexpected certificate info: %+v", info)
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	defer func() { config.Config = config.DefaultConfig() }()
+	config.Config.PinSPKI = []string{base64.StdEncoding.EncodeToString(spki[:])}
+	if reason := certMismatch(info); reason != "" {
+		t.Fatal("certificate should match its own SPKI pin")
+	}
+	config.Config.PinSPKI = []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+	if certMismatch(info) == "" {
+		t.Fatal("certificate should fail a foreign SPKI pin")
+	}
+	config.Config.PinSPKI = nil
+	config.Config.ExpectIssuer = "Cloudflare"
+	if certMismatch(info) == "" {
+		t.Fatal("self-signed certificate should fail --expect-issuer Cloudflare")
+	}
+}
+
+func TestPlainHTTPFailsCertChecks(t *testing.T) {
+	defer func() { config.Config = config.DefaultConfig() }()
+	config.Config = config.DefaultConfig()
+	config.Config.ExpectIssuer = "Cloudflare"
+	res, _ := performDownloadRound("127.0.0.1:1", "http://example.com/", time.Second, true, false)
+	if res.DTPassed || !strings.Contains(res.FailReason, "--expect-issuer") {
+		t.Fatalf("plain HTTP probe with --expect-issuer = %+v", res)
+	}
+}
+
+func TestClassifySNI(t *testing.T) {
+	if verdict, _ := ClassifySNI(map[string]bool{"a.com": true, "": true}); verdict != SNIVerdictHealthy {
+		t.Errorf("all passed: verdict = %q", verdict)
+	}
+	if verdict, _ := ClassifySNI(map[string]bool{"a.com": false, "": false}); verdict != SNIVerdictIPBlock {
+		t.Errorf("all failed: verdict = %q", verdict)
+	}
+	verdict, blocked := ClassifySNI(map[string]bool{"a.com": true, "b.com": false, "": true})
+	if verdict != SNIVerdictSNIBlock || len(blocked) != 1 || blocked[0] != "b.com" {
+		t.Errorf("mixed: verdict = %q, blocked = %v", verdict, blocked)
+	}
+}
+
+func TestGetTLSConfigUsesSNIOverride(t *testing.T) {
+	defer func() { config.Config = config.DefaultConfig() }()
+	req, err := http.NewRequest("GET", "https://origin.example.net/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewUTLSTransport(utls.HelloChrome_Auto, "1.1.1.1:443", time.Second)
+	if got := tr.getTLSConfig(req).ServerName; got != "origin.example.net" {
+		t.Fatalf("ServerName without --sni = %q", got)
+	}
+	config.Config.SNI = "harmless.example.com"
+	if got := tr.getTLSConfig(req).ServerName; got != "harmless.example.com" {
+		t.Fatalf("ServerName with --sni = %q", got)
+	}
+	if req.Host != "origin.example.net" {
+		t.Fatalf("--sni must not change the Host header, got %q", req.Host)
+	}
+}
+
+func TestNewProbeRequestAppliesOptions(t *testing.T) {
+	defer func() { config.Config = config.DefaultConfig() }()
+	config.Config.DTMethod = "POST"
+	config.Config.RequestBody = []byte("hello")
+	config.Config.RequestHeaders = http.Header{"Authorization": {"Bearer abc"}, "User-Agent": {"probe/1"}, "Host": {"zone.example.net"}}
+	req, err := newProbeRequest("https://speed.cloudflare.com/__down", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "POST" || req.ContentLength != 5 {
+		t.Fatalf("method/length = %s / %d", req.Method, req.ContentLength)
+	}
+	if req.Header.Get("Authorization") != "Bearer abc" || req.Header.Get("User-Agent") != "probe/1" {
+		t.Fatalf("headers = %v", req.Header)
+	}
+	if req.Header.Get("Cache-Control") != "no-cache" || req.Host != "zone.example.net" {
+		t.Fatalf("no-cache/host = %q / %q", req.Header.Get("Cache-Control"), req.Host)
+	}
+}
+
+func TestCheckDTResponse(t *testing.T) {
+	defer func() { config.Config = config.DefaultConfig() }()
+	config.Config.DTExpectHeaders = []string{"cf-ray", "Server: cloudflare"}
+	config.Config.DTExpectBodyRe = regexp.MustCompile(`colo=[A-Z]{3}`)
+	config.Config.DTExpectBody = config.Config.DTExpectBodyRe.String()
+	body := []byte("fl=1\ncolo=HKG\n")
+	sum := sha256.Sum256(body)
+	config.Config.DTExpectSHA256 = hex.EncodeToString(sum[:])
+	header := http.Header{"Cf-Ray": {"8a-HKG"}, "Server": {"cloudflare"}}
+
+	if reason := checkDTResponse(header, body); reason != "" {
+		t.Fatalf("expected a pass, got %q", reason)
+	}
+	if reason := checkDTResponse(http.Header{"Server": {"cloudflare"}}, body); !strings.Contains(reason, "Cf-Ray") {
+		t.Fatalf("missing cf-ray reason = %q", reason)
+	}
+	if reason := checkDTResponse(http.Header{"Cf-Ray": {"1"}, "Server": {"nginx"}}, body); !strings.Contains(reason, "Server") {
+		t.Fatalf("wrong server reason = %q", reason)
+	}
+	if reason := checkDTResponse(header, []byte("<html>captive portal</html>")); !strings.Contains(reason, "body does not match") {
+		t.Fatalf("block page reason = %q", reason)
+	}
+	if reason := checkDTResponse(header, []byte("colo=LAX\n")); !strings.Contains(reason, "sha256") {
+		t.Fatalf("sha256 reason = %q", reason)
+	}
+}
+
+func TestH3TransportProbe(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	udpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("UDP is not available: %v", err)
+	}
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cf-Ray", "test")
+			_, _ = io.WriteString(w, "ok")
+		}),
+	}
+	go func() { _ = server.Serve(udpConn) }()
+	defer server.Close()
+
+	// the URL host only supplies the SNI; the probe dials the candidate
+	client, tr := newProbeClient(udpConn.LocalAddr().String(), 5*time.Second, true)
+	tr.(*H3Transport).rootCAs = roots
+	defer tr.CloseIdleConnections()
+	resp, err := client.Get("https://example.com/")
+	if err != nil {
+		t.Fatalf("HTTP/3 probe failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "ok" || resp.Header.Get("Cf-Ray") != "test" {
+		t.Fatalf("unexpected response: %q, %v, headers %v", body, err, resp.Header)
+	}
+	if tr.Protocol() != "h3" {
+		t.Fatalf("Protocol() = %q, want h3", tr.Protocol())
+	}
+	handshake, ttfb := tr.Stat()
+	if handshake <= 0 || ttfb < 0 {
+		t.Fatalf("Stat() = %v, %v; want a positive handshake", handshake, ttfb)
+	}
+	if info := tr.CertInfo(); info.Subject != "CN=example.com" || info.TLSVersion != "TLS 1.3" {
+		t.Fatalf("unexpected certificate info: %+v", info)
+	}
+}
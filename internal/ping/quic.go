@@ -0,0 +1,155 @@
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"cftestor/internal/config"
+	"cftestor/internal/outbound"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// H3Transport runs HTTP/3 probes over QUIC. Like UTLSTransport it dials
+// hostWithPort whatever the URL host is, and records the handshake and the
+// time to the first response byte.
+type H3Transport struct {
+	hostWithPort string
+	rootCAs      *x509.CertPool // nil uses the system roots
+
+	// mu guards the fields below: quic-go calls dial from its own goroutine,
+	// while Stat and the other getters run on the probe's.
+	mu          sync.Mutex
+	tr          *http3.Transport
+	packetConns []net.PacketConn
+	quicConn    *quic.Conn
+	startAt     time.Time
+	handShookAt time.Time
+	responseAt  time.Time
+	sourceAddr  string
+}
+
+func NewH3Transport(hostWithPort string) *H3Transport {
+	return &H3Transport{hostWithPort: hostWithPort}
+}
+
+func (b *H3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme for HTTP/3: %s", req.URL.Scheme)
+	}
+	b.mu.Lock()
+	if b.tr == nil {
+		b.tr = &http3.Transport{
+			TLSClientConfig: b.getTLSConfig(req),
+			Dial:            b.dial,
+		}
+	}
+	tr := b.tr
+	b.mu.Unlock()
+	resp, err := tr.RoundTrip(req)
+	b.mu.Lock()
+	b.responseAt = time.Now()
+	b.mu.Unlock()
+	return resp, err
+}
+
+func (b *H3Transport) getTLSConfig(req *http.Request) *tls.Config {
+	hostName := req.URL.Hostname()
+	if len(config.Config.SNI) > 0 {
+		hostName = config.Config.SNI
+	}
+	return &tls.Config{ServerName: hostName, RootCAs: b.rootCAs}
+}
+
+func (b *H3Transport) dial(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	startAt := time.Now()
+	remote, err := net.ResolveUDPAddr("udp", b.hostWithPort)
+	if err != nil {
+		return nil, fmt.Errorf("udp resolve fail: %w", err)
+	}
+	pc, err := outbound.OutboundListenPacket(ctx, remote)
+	if err != nil {
+		return nil, fmt.Errorf("udp listen fail: %w", err)
+	}
+	b.mu.Lock()
+	// registered before the handshake so CloseIdleConnections can abort it
+	b.packetConns = append(b.packetConns, pc)
+	b.startAt = startAt
+	if outbound.SourcePoolActive() {
+		b.sourceAddr = outbound.SourceAddr(pc)
+	}
+	b.mu.Unlock()
+	conn, err := quic.Dial(ctx, pc, remote, tlsCfg, cfg)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handShookAt = time.Now()
+	if err != nil {
+		return nil, fmt.Errorf("quic handshake fail: %w", err)
+	}
+	b.quicConn = conn
+	return conn, nil
+}
+
+// Stat returns the QUIC handshake and the time to first byte after it.
+func (b *H3Transport) Stat() (time.Duration, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.handShookAt.Sub(b.startAt), b.responseAt.Sub(b.handShookAt)
+}
+
+// CertInfo describes the TLS session and certificate of the last round trip.
+func (b *H3Transport) CertInfo() config.CertInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.quicConn == nil {
+		return config.CertInfo{}
+	}
+	return certInfoFromQUIC(b.quicConn.ConnectionState().TLS)
+}
+
+// ProxyLeg is always 0: QUIC probes never go through --proxy.
+func (b *H3Transport) ProxyLeg() time.Duration {
+	return 0
+}
+
+// EdgeLeg is always 0, as for ProxyLeg.
+func (b *H3Transport) EdgeLeg() time.Duration {
+	return 0
+}
+
+// SourceAddr returns the --source-ips address of the last round trip.
+func (b *H3Transport) SourceAddr() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sourceAddr
+}
+
+// Protocol returns "h3" once a QUIC connection was made.
+func (b *H3Transport) Protocol() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.quicConn == nil {
+		return ""
+	}
+	return http3.NextProtoH3
+}
+
+func (b *H3Transport) CloseIdleConnections() {
+	// close outside mu, as a pending dial takes it once its handshake aborts
+	b.mu.Lock()
+	tr, packetConns := b.tr, b.packetConns
+	b.packetConns = nil
+	b.mu.Unlock()
+	if tr != nil {
+		tr.Close()
+	}
+	for _, pc := range packetConns {
+		pc.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package ping
+
+import (
+	"sort"
+	"time"
+
+	"cftestor/internal/config"
+	utls "github.com/refraction-networking/utls"
+)
+
+const (
+	SNIVerdictHealthy  = "healthy"
+	SNIVerdictIPBlock  = "IP-level block"
+	SNIVerdictSNIBlock = "SNI-level block"
+)
+
+// ProbeSNI tries up to DTCount TLS handshakes with sni and returns the fastest.
+// The certificate is not verified: the matrix only asks whether a handshake
+// with that SNI gets through. An empty sni omits the server_name extension.
+func ProbeSNI(host, sni string) (time.Duration, bool) {
+	conf := &utls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+	}
+	var best time.Duration
+	passed := false
+	for i := 0; i < config.Config.DTCount; i++ {
+		start := time.Now()
+		_, _, ok := dialUTLS(host, conf, config.Config.DTTimeoutDuration, config.Config.TLSClientID)
+		if ok {
+			if d := time.Since(start); !passed || d < best {
+				best = d
+			}
+			passed = true
+		}
+		if i < config.Config.DTCount-1 {
+			time.Sleep(time.Duration(config.Config.Interval) * time.Millisecond)
+		}
+	}
+	return best, passed
+}
+
+// ClassifySNI turns the per-SNI outcome for one IP into a verdict. When some
+// SNIs pass and others fail, the failing ones are returned as blocked.
+func ClassifySNI(passed map[string]bool) (string, []string) {
+	blocked := make([]string, 0)
+	for sni, ok := range passed {
+		if !ok {
+			blocked = append(blocked, sni)
+		}
+	}
+	sort.Strings(blocked)
+	switch len(blocked) {
+	case 0:
+		return SNIVerdictHealthy, nil
+	case len(passed):
+		return SNIVerdictIPBlock, nil
+	default:
+		return SNIVerdictSNIBlock, blocked
+	}
+}
@@ -2,11 +2,16 @@ package ping
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"math"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -74,14 +79,14 @@ func performDownloadRound(host, targetUrl string, httpRspTimeoutDur time.Duratio
 	}
 	var loc = ""
 
-	tReq, err := http.NewRequest("GET", targetUrl, nil)
+	tReq, err := newProbeRequest(targetUrl, applyNoCache)
 	if err != nil {
 		return currentResult, ""
 	}
-	tReq.Header.Set("User-Agent", config.Config.UserAgent)
-	if applyNoCache {
-		tReq.Header.Set("Cache-Control", "no-cache")
-		tReq.Header.Set("Pragma", "no-cache")
+	isTLS := tReq.URL.Scheme == "https"
+	if !isTLS && certChecked() {
+		currentResult.FailReason = fmt.Sprintf("%s has no certificate for --pin-spki or --expect-issuer", tReq.URL.Scheme)
+		return currentResult, ""
 	}
 
 	t_timeout := httpRspTimeoutDur
@@ -89,38 +94,82 @@ func performDownloadRound(host, targetUrl string, httpRspTimeoutDur time.Duratio
 		t_timeout = config.Config.DLTDurationInTotal
 	}
 
-	client, tr := NewHttpClient(config.Config.TLSClientID, host, t_timeout)
+	useH3 := config.Config.DLTHTTP3
+	if doDTOnly {
+		useH3 = config.Config.DTHTTP3
+	}
+	client, tr := newProbeClient(host, t_timeout, useH3)
 	defer tr.CloseIdleConnections()
+	currentResult.Transport = "tcp"
+	if useH3 {
+		currentResult.Transport = "quic"
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), t_timeout)
 	defer cancel()
 	tReq = tReq.WithContext(ctx)
 
 	response, err := client.Do(tReq)
+	currentResult.SourceAddr = tr.SourceAddr()
 	if err != nil || response == nil {
+		if err != nil {
+			currentResult.FailReason = err.Error()
+		}
 		return currentResult, ""
 	}
 	defer response.Body.Close()
 
+	currentResult.StatusCode = response.StatusCode
+	currentResult.CFRay = len(response.Header.Get("Cf-Ray")) > 0
+	if isTLS {
+		currentResult.Cert = tr.CertInfo()
+		if reason := certMismatch(currentResult.Cert); reason != "" {
+			currentResult.FailReason = reason
+			return currentResult, ""
+		}
+	}
+
+	var body io.Reader = response.Body
+	var bodyBytes []byte
+	if doDTOnly && config.DTExpectsBody() {
+		bodyBytes, err = io.ReadAll(io.LimitReader(response.Body, config.DTExpectBodyMax))
+		if err != nil {
+			currentResult.FailReason = fmt.Sprintf("read body: %v", err)
+			return currentResult, ""
+		}
+		body = bytes.NewReader(bodyBytes)
+	}
+
 	if response.Request.URL.Path == "/cdn-cgi/trace" && response.StatusCode == 200 {
-		loc, _ = getLocFromCFResp(response.Body)
+		loc, _ = getLocFromCFResp(body)
 	}
 
 	if doDTOnly {
-		if response.StatusCode == config.Config.DTHttpRspReturnCodeExpected {
+		if response.StatusCode != config.Config.DTHttpRspReturnCodeExpected {
+			currentResult.FailReason = fmt.Sprintf("status %d, want %d", response.StatusCode, config.Config.DTHttpRspReturnCodeExpected)
+		} else if reason := checkDTResponse(response.Header, bodyBytes); reason != "" {
+			currentResult.FailReason = reason
+		} else {
 			currentResult.DTPassed = true
 			currentResult.DTDuration, currentResult.HttpReqRspDur = tr.Stat()
+			currentResult.Proto = tr.Protocol()
+			currentResult.ProxyDuration = tr.ProxyLeg()
+			currentResult.EdgeDuration = tr.EdgeLeg()
 		}
 		return currentResult, loc
 	}
 
 	currentResult.DLTWasDone = true
 	if response.StatusCode != 200 {
+		currentResult.FailReason = fmt.Sprintf("status %d, want 200", response.StatusCode)
 		return currentResult, loc
 	}
 
 	currentResult.DTPassed = true
 	currentResult.DTDuration, currentResult.HttpReqRspDur = tr.Stat()
+	currentResult.Proto = tr.Protocol()
+	currentResult.ProxyDuration = tr.ProxyLeg()
+	currentResult.EdgeDuration = tr.EdgeLeg()
 
 	readAt := time.Now()
 	timeEndExpected := readAt.Add(config.Config.DLTDurationInTotal)
@@ -156,6 +205,79 @@ func performDownloadRound(host, targetUrl string, httpRspTimeoutDur time.Duratio
 	return currentResult, loc
 }
 
+// probeTransport is what a DT/DLT round reads back from UTLSTransport or
+// H3Transport after the request.
+type probeTransport interface {
+	http.RoundTripper
+	Stat() (time.Duration, time.Duration)
+	CertInfo() config.CertInfo
+	ProxyLeg() time.Duration
+	EdgeLeg() time.Duration
+	SourceAddr() string
+	Protocol() string
+	CloseIdleConnections()
+}
+
+func newProbeClient(host string, timeout time.Duration, useH3 bool) (*http.Client, probeTransport) {
+	if useH3 {
+		tr := NewH3Transport(host)
+		return &http.Client{Timeout: timeout, Transport: tr}, tr
+	}
+	return NewHttpClient(config.Config.TLSClientID, host, timeout)
+}
+
+// checkDTResponse applies --dt-expect-header, --dt-expect-body and
+// --dt-expect-sha256 and returns why the response was rejected, or "".
+func checkDTResponse(header http.Header, body []byte) string {
+	for _, expect := range config.Config.DTExpectHeaders {
+		name, want, hasValue := strings.Cut(expect, ":")
+		name, want = strings.TrimSpace(name), strings.TrimSpace(want)
+		got := header.Values(name)
+		if len(got) == 0 {
+			return fmt.Sprintf("missing header %s", http.CanonicalHeaderKey(name))
+		}
+		if hasValue && !slices.ContainsFunc(got, func(v string) bool { return strings.Contains(v, want) }) {
+			return fmt.Sprintf("header %s is %q, want %q", http.CanonicalHeaderKey(name), got[0], want)
+		}
+	}
+	if config.Config.DTExpectBodyRe != nil && !config.Config.DTExpectBodyRe.Match(body) {
+		return fmt.Sprintf("body does not match %q", config.Config.DTExpectBody)
+	}
+	if len(config.Config.DTExpectSHA256) > 0 {
+		sum := sha256.Sum256(body)
+		if got := hex.EncodeToString(sum[:]); got != config.Config.DTExpectSHA256 {
+			return fmt.Sprintf("body sha256 %s, want %s", got, config.Config.DTExpectSHA256)
+		}
+	}
+	return ""
+}
+
+// newProbeRequest builds a DT/DLT request with --dt-method, the request body
+// and --header values, which override the default headers.
+func newProbeRequest(targetUrl string, applyNoCache bool) (*http.Request, error) {
+	var body io.Reader
+	if len(config.Config.RequestBody) > 0 {
+		body = bytes.NewReader(config.Config.RequestBody)
+	}
+	tReq, err := http.NewRequest(config.Config.DTMethod, targetUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	tReq.Header.Set("User-Agent", config.Config.UserAgent)
+	if applyNoCache {
+		tReq.Header.Set("Cache-Control", "no-cache")
+		tReq.Header.Set("Pragma", "no-cache")
+	}
+	for name, values := range config.Config.RequestHeaders {
+		if name == "Host" {
+			tReq.Host = values[len(values)-1]
+			continue
+		}
+		tReq.Header[name] = values
+	}
+	return tReq, nil
+}
+
 func getLocFromCFResp(body io.Reader) (string, error) {
 	loc := ""
 	scanner := bufio.NewScanner(body)
@@ -218,16 +340,29 @@ func sslDTHandlerNew(host *string, max_failure int) []config.SingleResult {
 			DLTPassed:     false,
 			DLTDuration:   0,
 			DLTDataSize:   0,
+			Transport:     "tcp",
 		}
 		var timeStart = time.Now()
-		ok := PerformUtlsDial(*host, config.Config.HostName, config.Config.DTTimeoutDuration, config.Config.TLSClientID)
+		state, dialInfo, ok := PerformUtlsDial(*host, config.Config.HostName, config.Config.DTTimeoutDuration, config.Config.TLSClientID)
 		tDur := time.Since(timeStart)
+		currentResult.SourceAddr = dialInfo.SourceAddr
+		if !ok {
+			currentResult.FailReason = "TLS handshake failed"
+		} else {
+			currentResult.Cert = certInfoFromState(state)
+			if currentResult.FailReason = certMismatch(currentResult.Cert); currentResult.FailReason != "" {
+				ok = false
+			}
+		}
 		if !ok {
 			allResult = append(allResult, currentResult)
 			t_failure_counter += 1
 		} else {
 			currentResult.DTPassed = true
 			currentResult.DTDuration = tDur
+			currentResult.Proto = state.NegotiatedProtocol
+			currentResult.ProxyDuration = dialInfo.ProxyLeg
+			currentResult.EdgeDuration = dialInfo.EdgeLeg
 			allResult = append(allResult, currentResult)
 		}
 		if !config.Config.EnableDTEvaluation || t_failure_counter > max_failure {
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"cftestor/internal/config"
 	"cftestor/internal/outbound"
 	utls "github.com/refraction-networking/utls"
 	"golang.org/x/net/http2"
@@ -29,6 +30,10 @@ type UTLSTransport struct {
 	timeout        time.Duration
 	tlsHandShookAt time.Time
 	responseAt     time.Time
+	negotiated     string
+	proxyLeg       time.Duration
+	edgeLeg        time.Duration
+	sourceAddr     string
 	conn           net.Conn
 	h2Conn         *http2.ClientConn
 	tlsConn        *utls.UConn
@@ -62,6 +67,10 @@ func (b *UTLSTransport) httpsRoundTrip(req *http.Request) (*http.Response, error
 	if err != nil {
 		return nil, fmt.Errorf("tcp net dial fail: %w", err)
 	}
+	b.proxyLeg, b.edgeLeg, _ = outbound.ProxyTimings(b.conn)
+	if outbound.SourcePoolActive() {
+		b.sourceAddr = outbound.SourceAddr(b.conn)
+	}
 
 	b.tlsConn, err = b.tlsConnect(b.conn, req)
 	b.tlsHandShookAt = time.Now()
@@ -70,6 +79,10 @@ func (b *UTLSTransport) httpsRoundTrip(req *http.Request) (*http.Response, error
 	}
 	b.tlsHandShookAt = time.Now()
 	httpVersion := b.tlsConn.ConnectionState().NegotiatedProtocol
+	b.negotiated = httpVersion
+	if len(b.negotiated) == 0 {
+		b.negotiated = "http/1.1"
+	}
 	resp := &http.Response{}
 	switch httpVersion {
 	case "h2":
@@ -100,6 +113,9 @@ func (b *UTLSTransport) getTLSConfig(req *http.Request) *utls.Config {
 	if err != nil {
 		host_name = req.URL.Host
 	}
+	if len(config.Config.SNI) > 0 {
+		host_name = config.Config.SNI
+	}
 	return &utls.Config{
 		ServerName:         host_name,
 		InsecureSkipVerify: false,
@@ -108,8 +124,11 @@ func (b *UTLSTransport) getTLSConfig(req *http.Request) *utls.Config {
 
 func (b *UTLSTransport) tlsConnect(conn net.Conn, req *http.Request) (*utls.UConn, error) {
 	b.mu.RLock()
-	tlsConn := utls.UClient(conn, b.getTLSConfig(req), b.clientHello)
+	tlsConn, err := outbound.NewUClient(conn, b.getTLSConfig(req), b.clientHello, config.ForcedALPN())
 	b.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
 
 	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
 		return nil, fmt.Errorf("tls handshake fail: %w", err)
@@ -121,6 +140,39 @@ func (b *UTLSTransport) Stat() (time.Duration, time.Duration) {
 	return b.tlsHandShookAt.Sub(b.startAt), b.responseAt.Sub(b.tlsHandShookAt)
 }
 
+// ConnectionState returns the TLS state of the last round trip.
+func (b *UTLSTransport) ConnectionState() utls.ConnectionState {
+	if b.tlsConn == nil {
+		return utls.ConnectionState{}
+	}
+	return b.tlsConn.ConnectionState()
+}
+
+// CertInfo describes the TLS session and certificate of the last round trip.
+func (b *UTLSTransport) CertInfo() config.CertInfo {
+	return certInfoFromState(b.ConnectionState())
+}
+
+// ProxyLeg returns the time spent reaching --proxy, or 0 for direct dials.
+func (b *UTLSTransport) ProxyLeg() time.Duration {
+	return b.proxyLeg
+}
+
+// EdgeLeg returns the time --proxy took to reach the edge, or 0 for direct dials.
+func (b *UTLSTransport) EdgeLeg() time.Duration {
+	return b.edgeLeg
+}
+
+// SourceAddr returns the --source-ips address of the last round trip.
+func (b *UTLSTransport) SourceAddr() string {
+	return b.sourceAddr
+}
+
+// Protocol returns the HTTP version negotiated by the last round trip.
+func (b *UTLSTransport) Protocol() string {
+	return b.negotiated
+}
+
 func (b *UTLSTransport) SetClientHello(hello utls.ClientHelloID) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -153,22 +205,47 @@ func NewHttpClient(helloID utls.ClientHelloID, hostWithPort string, timeout time
 	return client, tr
 }
 
-func PerformUtlsDial(host string, hostNameStr string, timeout time.Duration, hellID utls.ClientHelloID) bool {
+// DialInfo describes the connection a handshake ran over.
+type DialInfo struct {
+	// ProxyLeg is the time spent reaching --proxy
+	ProxyLeg time.Duration
+	// EdgeLeg is the time --proxy took to reach the edge
+	EdgeLeg time.Duration
+	// SourceAddr is the --source-ips address the connection used
+	SourceAddr string
+}
+
+// PerformUtlsDial runs one TLS handshake with host.
+func PerformUtlsDial(host string, hostNameStr string, timeout time.Duration, hellID utls.ClientHelloID) (utls.ConnectionState, DialInfo, bool) {
+	conf := &utls.Config{
+		ServerName: hostNameStr,
+	}
+	return dialUTLS(host, conf, timeout, hellID)
+}
+
+func dialUTLS(host string, conf *utls.Config, timeout time.Duration, hellID utls.ClientHelloID) (utls.ConnectionState, DialInfo, bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	var info DialInfo
 	dialConn, err := outbound.OutboundDialContext(ctx, "tcp", host)
 	if err != nil {
-		return false
+		return utls.ConnectionState{}, info, false
+	}
+	defer dialConn.Close()
+	info.ProxyLeg, info.EdgeLeg, _ = outbound.ProxyTimings(dialConn)
+	if outbound.SourcePoolActive() {
+		info.SourceAddr = outbound.SourceAddr(dialConn)
 	}
 
-	conf := &utls.Config{
-		ServerName: hostNameStr,
+	tlsConn, err := outbound.NewUClient(dialConn, conf, hellID, config.ForcedALPN())
+	if err != nil {
+		return utls.ConnectionState{}, info, false
 	}
-	tlsConn := utls.UClient(dialConn, conf, hellID)
+	defer tlsConn.Close()
 
-	err = tlsConn.HandshakeContext(ctx)
-	tlsConn.Close()
-	dialConn.Close()
-	return err == nil
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return utls.ConnectionState{}, info, false
+	}
+	return tlsConn.ConnectionState(), info, true
 }
@@ -5,107 +5,151 @@ import (
 	"math/big"
 	"math/rand"
 	"net"
+	"net/netip"
 )
 
+// IPRange is an inclusive span of addresses of one family. Addresses are
+// held as 128-bit integers so extraction is plain arithmetic.
 type IPRange struct {
-	IPStart   net.IP
-	IPEnd     net.IP
-	Len       *big.Int
-	Extracted bool
+	// first and last bound the addresses not extracted yet
+	first, last Uint128
+	is6         bool
+	Extracted   bool
+	// set by the first random draw; first then stays put and drawn is
+	// the next offset of perm to hand out
+	perm  *Permutation
+	drawn Uint128
+	// set by the first block draw: the walk of each block touched so far,
+	// keyed by its lowest address, and the addresses drawn over all blocks
+	blocks     map[Uint128]*blockDraw
+	blockDrawn Uint128
+}
+
+// blockDraw walks a keyed permutation of one block's offsets.
+type blockDraw struct {
+	perm  *Permutation
+	drawn Uint128
+	done  bool
 }
 
 func (ipr *IPRange) isValid() bool {
-	if ipr == nil || ipr.IPStart == nil || ipr.IPEnd == nil || ipr.Extracted {
-		return false
-	}
-	if len(ipr.IPStart) != len(ipr.IPEnd) {
-		return false
-	} else if len(ipr.IPStart) != net.IPv4len && len(ipr.IPStart) != net.IPv6len {
-		return false
-	} else {
-		for i := 0; i < len(ipr.IPStart); i++ {
-			if (ipr.IPStart)[i] > (ipr.IPEnd)[i] {
-				return false
-			}
-		}
-	}
-	return true
+	return ipr != nil && !ipr.Extracted
 }
 
 func (ipr *IPRange) IsValid() bool {
 	return ipr.isValid()
 }
 
+// span is the number of addresses left minus one, so a full ::/0 fits.
+func (ipr *IPRange) span() Uint128 {
+	if ipr.perm != nil {
+		return ipr.perm.max.Sub(ipr.drawn)
+	}
+	if ipr.blocks != nil {
+		return ipr.last.Sub(ipr.first).Sub(ipr.blockDrawn)
+	}
+	return ipr.last.Sub(ipr.first)
+}
+
 func (ipr *IPRange) length() *big.Int {
 	if !ipr.isValid() {
 		return big.NewInt(0)
 	}
-	var newLenBytes = make([]byte, len(ipr.IPEnd), cap(ipr.IPEnd))
-	reduce := 0
-	for i := len(ipr.IPStart) - 1; i >= 0; i-- {
-		m := (ipr.IPStart)[i]
-		n := (ipr.IPEnd)[i]
-		newValue := int(n) - int(m) - reduce
-		// n < m + reduce, borrow from i - 1
-		if newValue < 0 {
-			reduce = 1
-			newValue += int(1 << 8)
-		} else {
-			// reset reduce
-			reduce = 0
-		}
-		newLenBytes[i] = byte(newValue)
-	}
-	newLen := big.NewInt(0).SetBytes(newLenBytes)
-	// add 1 more
-	newLen = newLen.Add(newLen, big.NewInt(1))
-	return newLen
+	n := ipr.span().Big()
+	return n.Add(n, big.NewInt(1))
 }
 
 func (ipr *IPRange) Length() *big.Int {
 	return ipr.length()
 }
 
-func (ipr *IPRange) isV4() bool {
-	if !ipr.isValid() {
-		return false
-	}
-	return len(ipr.IPStart) == net.IPv4len
-}
-
-func (ipr *IPRange) isV6() bool {
-	if !ipr.isValid() {
-		return false
-	}
-	return len(ipr.IPStart) == net.IPv6len
+// IsEmpty reports whether every address has been extracted. It is cheaper
+// than comparing Length with zero.
+func (ipr *IPRange) IsEmpty() bool {
+	return !ipr.isValid()
 }
 
 func (ipr *IPRange) IsV4() bool {
-	return ipr.isV4()
+	return ipr.isValid() && !ipr.is6
 }
 
 func (ipr *IPRange) IsV6() bool {
-	return ipr.isV6()
+	return ipr.isValid() && ipr.is6
+}
+
+// Start and End return the bounds of the addresses not extracted yet.
+func (ipr *IPRange) Start() netip.Addr {
+	return ipr.first.Addr(ipr.is6)
 }
 
-func (ipr *IPRange) init(StartIP net.IP, EndIP net.IP) *IPRange {
-	t_s_startIP := StartIP
-	if t_s_startIP.To4() != nil {
-		t_s_startIP = t_s_startIP.To4()
+func (ipr *IPRange) End() netip.Addr {
+	return ipr.last.Addr(ipr.is6)
+}
+
+// Contains reports whether addr lies within the range.
+func (ipr *IPRange) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !ipr.isValid() || !addr.IsValid() || addr.Is6() != ipr.is6 {
+		return false
 	}
-	t_s_endIP := EndIP
-	if t_s_endIP.To4() != nil {
-		t_s_endIP = t_s_endIP.To4()
+	u := Uint128FromAddr(addr)
+	return u.Cmp(ipr.first) >= 0 && u.Cmp(ipr.last) <= 0
+}
+
+// BlockCount returns how many aligned blocks of 2^hostBits addresses, such
+// as /24s for hostBits 8, the range touches.
+func (ipr *IPRange) BlockCount(hostBits uint) *big.Int {
+	if !ipr.isValid() {
+		return big.NewInt(0)
 	}
-	ipr.IPStart = t_s_startIP
-	ipr.IPEnd = t_s_endIP
+	n := ipr.last.Rsh(hostBits).Sub(ipr.first.Rsh(hostBits)).Big()
+	return n.Add(n, big.NewInt(1))
+}
 
-	ipr.Extracted = false
-	if ipr.isValid() {
-		ipr.Len = ipr.length()
-		return ipr
+// DrawInBlock draws an address of the range inside its block'th aligned
+// block of 2^hostBits addresses, such as a /24 for hostBits 8. Each block
+// walks its own keyed permutation, so no address repeats and Length counts
+// the addresses not drawn yet. It reports false once the block has no
+// addresses left. Block draws must not be mixed with the other draws on the
+// same range.
+func (ipr *IPRange) DrawInBlock(r *rand.Rand, hostBits uint, block *big.Int) (netip.Addr, bool) {
+	if !ipr.isValid() || ipr.perm != nil {
+		return netip.Addr{}, false
+	}
+	lo := ipr.first.Rsh(hostBits).Add(Uint128FromBig(block)).Lsh(hostBits)
+	hi := lo.Add(Uint128{Lo: 1}.Lsh(hostBits)).Sub64(1)
+	if lo.Cmp(ipr.first) < 0 {
+		lo = ipr.first
+	}
+	if hi.Cmp(ipr.last) > 0 {
+		hi = ipr.last
+	}
+	if lo.Cmp(hi) > 0 {
+		return netip.Addr{}, false
+	}
+	if ipr.blocks == nil {
+		ipr.blocks = make(map[Uint128]*blockDraw)
+	}
+	bd, ok := ipr.blocks[lo]
+	if !ok {
+		bd = &blockDraw{perm: NewPermutation(r, hi.Sub(lo))}
+		ipr.blocks[lo] = bd
+	}
+	if bd.done {
+		return netip.Addr{}, false
+	}
+	addr := lo.Add(bd.perm.At(bd.drawn)).Addr(ipr.is6)
+	if bd.drawn == bd.perm.max {
+		bd.done = true
+	} else {
+		bd.drawn = bd.drawn.Add64(1)
+	}
+	if ipr.blockDrawn == ipr.last.Sub(ipr.first) {
+		ipr.Extracted = true
+	} else {
+		ipr.blockDrawn = ipr.blockDrawn.Add64(1)
 	}
-	return nil
+	return addr, true
 }
 
 func (ipr *IPRange) String() string {
@@ -113,219 +157,133 @@ func (ipr *IPRange) String() string {
 		return "null"
 	}
 	return fmt.Sprintf("Start With: %s; End With: %s; Length: %s; Extracted: %t",
-		(ipr.IPStart).String(), (ipr.IPEnd).String(), (ipr.length()).String(), ipr.Extracted)
+		ipr.Start(), ipr.End(), ipr.length(), ipr.Extracted)
 }
 
-func (ipr *IPRange) Extract(num int) (IPList []net.IP) {
-	if !ipr.isValid() || num <= 0 || ipr.Extracted || ipr.Len.Cmp(big.NewInt(0)) == 0 {
+// Extract takes up to num addresses from the start of the range.
+func (ipr *IPRange) Extract(num int) (IPList []netip.Addr) {
+	if !ipr.isValid() || num <= 0 {
 		return
 	}
-	numBig := big.NewInt(int64(num))
-	if ipr.Len.Cmp(numBig) == -1 {
-		num = int(ipr.Len.Int64())
-		numBig = big.NewInt(int64(num))
+	if ipr.perm != nil {
+		return ipr.drawPermuted(num)
 	}
-
-	for i := 0; i < num; i++ {
-		n := big.NewInt(int64(i))
-		num_in_bytes := fillBytes(n.Bytes(), len(ipr.IPStart))
-		newIP := ipShift(ipr.IPStart, num_in_bytes)
-		if newIP != nil {
-			IPList = append(IPList, newIP)
+	IPList = make([]netip.Addr, 0, ipr.capped(num))
+	for len(IPList) < num {
+		IPList = append(IPList, ipr.first.Addr(ipr.is6))
+		if ipr.first == ipr.last {
+			ipr.Extracted = true
+			break
 		}
-	}
-
-	// reset IPStart and Extracted
-	if numBig.Cmp(ipr.Len) == 0 {
-		ipr.Extracted = true
-		ipr.Len = big.NewInt(0)
-		ipr.IPStart = ipr.IPEnd
-	} else {
-		num_in_bytes := fillBytes(numBig.Bytes(), len(ipr.IPStart))
-		ipr.IPStart = ipShift(ipr.IPStart, num_in_bytes)
-		ipr.Len = ipr.length()
+		ipr.first = ipr.first.Add64(1)
 	}
 	return
 }
 
-func (ipr *IPRange) ExtractReverse(num int) (IPList []net.IP) {
-	if !ipr.isValid() || num <= 0 || ipr.Extracted || ipr.Len.Cmp(big.NewInt(0)) == 0 {
+// ExtractReverse takes up to num addresses from the end of the range.
+func (ipr *IPRange) ExtractReverse(num int) (IPList []netip.Addr) {
+	if !ipr.isValid() || num <= 0 {
 		return
 	}
-	numBig := big.NewInt(int64(num))
-	if ipr.Len.Cmp(numBig) == -1 {
-		num = int(ipr.Len.Int64())
-		numBig = big.NewInt(int64(num))
+	if ipr.perm != nil {
+		return ipr.drawPermuted(num)
 	}
-
-	for i := 0; i < num; i++ {
-		n := big.NewInt(int64(i))
-		num_in_bytes := fillBytes(n.Bytes(), len(ipr.IPEnd))
-		newIP := ipShiftReverse(ipr.IPEnd, num_in_bytes)
-		if newIP != nil {
-			IPList = append(IPList, newIP)
+	IPList = make([]netip.Addr, 0, ipr.capped(num))
+	for len(IPList) < num {
+		IPList = append(IPList, ipr.last.Addr(ipr.is6))
+		if ipr.first == ipr.last {
+			ipr.Extracted = true
+			break
 		}
+		ipr.last = ipr.last.Sub64(1)
 	}
+	return
+}
 
-	// reset IPEnd and Extracted
-	if numBig.Cmp(ipr.Len) == 0 {
-		ipr.Extracted = true
-		ipr.Len = big.NewInt(0)
-		ipr.IPEnd = ipr.IPStart
-	} else {
-		num_in_bytes := fillBytes(numBig.Bytes(), len(ipr.IPEnd))
-		ipr.IPEnd = ipShiftReverse(ipr.IPEnd, num_in_bytes)
-		ipr.Len = ipr.length()
+// capped limits num to the addresses left, for preallocation.
+func (ipr *IPRange) capped(num int) int {
+	if s := ipr.span(); s.Hi == 0 && s.Lo < uint64(num) {
+		return int(s.Lo) + 1
 	}
-	return
+	return num
 }
 
-func (ipr *IPRange) ExtractAll(maxHostLen int) (IPList []net.IP) {
+func (ipr *IPRange) ExtractAll(maxHostLen int) (IPList []netip.Addr) {
 	// we limit the max result length to MaxHostLen (currently, 65536), if it's to big, return nil
 	// or it's don't have any IPS to extract, return nil
-	if ipr.Extracted || ipr.Len.Cmp(big.NewInt(0)) == 0 || ipr.Len.Cmp(big.NewInt(int64(maxHostLen))) == 1 {
+	if !ipr.isValid() || ipr.span().Cmp(Uint128{Lo: uint64(maxHostLen)}) >= 0 {
 		return
 	}
-	return ipr.Extract(int(ipr.Len.Int64()))
+	return ipr.Extract(maxHostLen)
 }
 
-func (ipr *IPRange) GetRandomX(r *rand.Rand, num int) (IPList []net.IP) {
-	// or it's don't have any IPS to extract, return nil
-	if ipr.Extracted || ipr.Len.Cmp(big.NewInt(0)) == 0 {
+// GetRandomX draws num random addresses without replacement. Draws walk a
+// keyed permutation of the range, so no address repeats, memory stays
+// constant, and Length counts the addresses not drawn yet.
+func (ipr *IPRange) GetRandomX(r *rand.Rand, num int) (IPList []netip.Addr) {
+	if !ipr.isValid() || num <= 0 {
 		return
 	}
-	// we extract all while ipr don't have enough ips for extracted
-	if big.NewInt(int64(num)).Cmp(ipr.Len) >= 0 {
-		m := ipr.Extract(int(ipr.Len.Int64()))
-		if m == nil {
-			return
-		}
-		IPList = append(IPList, m...)
-		// shuffle
-		r.Shuffle(len(IPList), func(i, j int) {
-			IPList[i], IPList[j] = IPList[j], IPList[i]
-		})
-		// we done here
-		return
-	}
-	// get randomly
-	i := 0
-	for i < num {
-		n := big.NewInt(0)
-		n = n.Rand(r, ipr.Len)
-		num_in_bytes := fillBytes(n.Bytes(), len(ipr.IPStart))
-		newIP := ipShift(ipr.IPStart, num_in_bytes)
-		if newIP != nil {
-			IPList = append(IPList, newIP)
-			i++
-		}
+	if ipr.perm == nil {
+		ipr.perm = NewPermutation(r, ipr.span())
+		ipr.drawn = Uint128{}
 	}
-	return
-}
-
-func NewIPRangeFromIP(StartIP net.IP, EndIP net.IP) *IPRange {
-	return new(IPRange).init(StartIP, EndIP)
-}
-
-func NewIPRangeFromString(StartIPStr *string, EndIPStr *string) *IPRange {
-	StartIP := net.ParseIP(*StartIPStr)
-	EndIP := net.ParseIP(*EndIPStr)
-	return new(IPRange).init(StartIP, EndIP)
+	return ipr.drawPermuted(num)
 }
 
-func NewIPRangeFromCIDR(cidr *string) *IPRange {
-	ip, ipCIDR, err := net.ParseCIDR(*cidr)
-	if err != nil {
-		tIP := net.ParseIP(*cidr)
-		if tIP != nil {
-			return new(IPRange).init(tIP, tIP)
+func (ipr *IPRange) drawPermuted(num int) (IPList []netip.Addr) {
+	IPList = make([]netip.Addr, 0, ipr.capped(num))
+	for len(IPList) < num && !ipr.Extracted {
+		IPList = append(IPList, ipr.first.Add(ipr.perm.At(ipr.drawn)).Addr(ipr.is6))
+		if ipr.drawn == ipr.perm.max {
+			ipr.Extracted = true
+		} else {
+			ipr.drawn = ipr.drawn.Add64(1)
 		}
-		return nil
-	}
-	if !ip.Equal(ipCIDR.IP) {
-		return new(IPRange).init(ip, ip)
-	}
-	var StartIP net.IP
-	if len(ipCIDR.IP) == net.IPv4len {
-		StartIP = ip.To4()
-	} else {
-		StartIP = ip.To16()
-	}
-	EndIP := net.IP(make([]byte, len(StartIP)))
-	for i := 0; i < len(StartIP); i++ {
-		EndIP[i] = StartIP[i] | ^ipCIDR.Mask[i]
 	}
-	return new(IPRange).init(StartIP, EndIP)
+	return
 }
 
-func fillBytes(s []byte, l int) []byte {
-	if len(s) >= l {
-		return s
+func newIPRange(start, end netip.Addr) *IPRange {
+	start, end = start.Unmap(), end.Unmap()
+	if !start.IsValid() || !end.IsValid() || start.Is6() != end.Is6() || start.Zone() != "" || end.Zone() != "" {
+		return nil
 	}
-	newBytes := make([]byte, l)
-	i := len(s) - 1
-	j := len(newBytes) - 1
-	for i >= 0 {
-		newBytes[j] = s[i]
-		i--
-		j--
+	ipr := &IPRange{first: Uint128FromAddr(start), last: Uint128FromAddr(end), is6: start.Is6()}
+	if ipr.first.Cmp(ipr.last) > 0 {
+		return nil
 	}
-	return newBytes
+	return ipr
 }
 
-func makeBytes(num uint, len int) []byte {
-	newBytes := make([]byte, len)
-	for i := int(len - 1); i >= 0; i-- {
-		newBytes[i] = byte(num % (1 << 8))
-		num = num >> 8
-	}
-	if num > 0 {
-		return nil
-	}
-	return newBytes
+func NewIPRangeFromIP(StartIP net.IP, EndIP net.IP) *IPRange {
+	start, _ := netip.AddrFromSlice(StartIP)
+	end, _ := netip.AddrFromSlice(EndIP)
+	return newIPRange(start, end)
 }
 
-func ipShift(ip net.IP, num []byte) net.IP {
-	if len(num) > len(ip) {
-		return nil
-	}
-	newIP := net.IP(make([]byte, len(ip)))
-	_ = copy(newIP, ip)
-	num = fillBytes(num, len(newIP))
-	add := uint(0)
-	lengthForThis := len(newIP)
-	for i := lengthForThis - 1; i >= 0; i-- {
-		m := uint(newIP[i]) + uint(num[i]) + add
-		add = m >> 8
-		newIP[i] = byte(m % (1 << 8))
-	}
-	if add > 0 {
-		return nil
-	} else {
-		return newIP
-	}
+func NewIPRangeFromString(StartIPStr *string, EndIPStr *string) *IPRange {
+	start, _ := netip.ParseAddr(*StartIPStr)
+	end, _ := netip.ParseAddr(*EndIPStr)
+	return newIPRange(start, end)
 }
 
-func ipShiftReverse(ip net.IP, num []byte) net.IP {
-	if len(num) > len(ip) {
-		return nil
-	}
-	newIP := net.IP(make([]byte, len(ip)))
-	_ = copy(newIP, ip)
-	num = fillBytes(num, len(newIP))
-	reduce := 0
-	lengthForThis := len(newIP)
-	for i := lengthForThis - 1; i >= 0; i-- {
-		m := int(newIP[i]) - int(num[i]) - reduce
-		if m >= 0 {
-			newIP[i] = byte(m)
-		} else {
-			newIP[i] = byte(1<<8 + m)
-			reduce = 1
+func NewIPRangeFromCIDR(cidr *string) *IPRange {
+	prefix, err := netip.ParsePrefix(*cidr)
+	if err != nil {
+		addr, err := netip.ParseAddr(*cidr)
+		if err != nil {
+			return nil
 		}
+		return newIPRange(addr, addr)
 	}
-	if reduce > 0 {
-		return nil
+	// a host address with a prefix length, like 1.0.0.1/24, is that address
+	if prefix.Addr() != prefix.Masked().Addr() {
+		return newIPRange(prefix.Addr(), prefix.Addr())
 	}
-	return newIP
+	start := prefix.Addr()
+	hostBits := uint(start.BitLen() - prefix.Bits())
+	// for ::/0 the shift yields 0 and the subtraction wraps to all ones
+	last := Uint128FromAddr(start).Add(Uint128{Lo: 1}.Lsh(hostBits).Sub64(1))
+	return newIPRange(start, last.Addr(start.Is6()))
 }
@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"math/big"
 	"math/rand"
+	"net/netip"
 	"testing"
 )
 
@@ -63,7 +65,7 @@ func TestIPRangeIPv6RandomExtraction(t *testing.T) {
 		t.Fatalf("expected 5 random IPs, got %d", len(randomIPs))
 	}
 	for _, ip := range randomIPs {
-		if ip.To4() != nil {
+		if ip.Is4() {
 			t.Errorf("expected IPv6 address, got %v", ip)
 		}
 	}
@@ -172,3 +174,121 @@ func TestUrlHelpers(t *testing.T) {
 		t.Errorf("NewUrl unexpected URL: %s", newUrl)
 	}
 }
+
+func TestIPRangeAcrossOctetsAndContains(t *testing.T) {
+	start, end := "1.2.3.200", "1.2.4.10"
+	ipr := NewIPRangeFromString(&start, &end)
+	if ipr == nil || ipr.Length().Int64() != 67 {
+		t.Fatalf("expected a 67 address range, got %v", ipr)
+	}
+	if !ipr.Contains(netip.MustParseAddr("1.2.3.255")) || ipr.Contains(netip.MustParseAddr("1.2.4.11")) || ipr.Contains(netip.MustParseAddr("::1")) {
+		t.Errorf("unexpected Contains results for %v", ipr)
+	}
+	if NewIPRangeFromString(&end, &start) != nil {
+		t.Errorf("expected a reversed range to be rejected")
+	}
+}
+
+func TestPermutationIsBijective(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	for _, n := range []int64{1, 2, 3, 255, 256, 1000, 4097} {
+		p := NewPermutation(r, Uint128{Lo: uint64(n - 1)})
+		seen := make(map[int64]bool, n)
+		for i := range n {
+			v := int64(p.At(Uint128{Lo: uint64(i)}).Lo)
+			if v < 0 || v >= n || seen[v] {
+				t.Fatalf("n=%d: At(%d) = %d is out of range or repeated", n, i, v)
+			}
+			seen[v] = true
+		}
+	}
+}
+
+func TestIPRangeRandomDrawsDoNotRepeat(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cidr := "10.0.0.0/22"
+	ipr := NewIPRangeFromCIDR(&cidr)
+	seen := map[string]bool{}
+	for ipr.Length().Sign() > 0 {
+		before := ipr.Length().Int64()
+		got := ipr.GetRandomX(r, 100)
+		if ipr.Length().Int64() != before-int64(len(got)) {
+			t.Fatalf("Length went from %d to %v after drawing %d", before, ipr.Length(), len(got))
+		}
+		for _, ip := range got {
+			if seen[ip.String()] {
+				t.Fatalf("%s drawn twice", ip)
+			}
+			seen[ip.String()] = true
+		}
+	}
+	if len(seen) != 1024 || ipr.GetRandomX(r, 1) != nil || ipr.Extract(1) != nil {
+		t.Fatalf("expected exactly 1024 draws and an exhausted range, got %d", len(seen))
+	}
+
+	// a huge IPv6 range keeps its size exact while being sampled
+	cidr6 := "2606:4700::/29"
+	ipr6 := NewIPRangeFromCIDR(&cidr6)
+	total := new(big.Int).Set(ipr6.Length())
+	seen = map[string]bool{}
+	for _, ip := range ipr6.GetRandomX(r, 20000) {
+		if seen[ip.String()] {
+			t.Fatalf("%s drawn twice", ip)
+		}
+		seen[ip.String()] = true
+	}
+	if left := new(big.Int).Sub(total, ipr6.Length()); left.Int64() != 20000 {
+		t.Errorf("expected Length to drop by 20000, dropped by %v", left)
+	}
+}
+
+func TestIPRangeWholeIPv6Space(t *testing.T) {
+	cidr := "::/0"
+	ipr := NewIPRangeFromCIDR(&cidr)
+	want := new(big.Int).Lsh(big.NewInt(1), 128)
+	if ipr == nil || ipr.Length().Cmp(want) != 0 {
+		t.Fatalf("expected 2^128 addresses in ::/0, got %v", ipr)
+	}
+	if got := ipr.ExtractReverse(2); len(got) != 2 || got[0].String() != "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff" || got[1].String() != "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe" {
+		t.Errorf("unexpected addresses from the end of ::/0: %v", got)
+	}
+	if left := new(big.Int).Sub(want, ipr.Length()); left.Int64() != 2 {
+		t.Errorf("expected Length to drop by 2, dropped by %v", left)
+	}
+	single := "255.255.255.255"
+	last := NewIPRangeFromCIDR(&single)
+	if got := last.Extract(5); len(got) != 1 || !last.IsEmpty() {
+		t.Errorf("expected one address and an empty range, got %v", got)
+	}
+}
+
+func BenchmarkIPRangeExtractV6(b *testing.B) {
+	cidr := "2606:4700::/32"
+	ipr := NewIPRangeFromCIDR(&cidr)
+	b.ReportAllocs()
+	for b.Loop() {
+		ipr.Extract(1)
+	}
+}
+
+func BenchmarkIPRangeGetRandomXV6(b *testing.B) {
+	cidr := "2606:4700::/29"
+	ipr := NewIPRangeFromCIDR(&cidr)
+	r := rand.New(rand.NewSource(1))
+	b.ReportAllocs()
+	for b.Loop() {
+		ipr.GetRandomX(r, 1)
+	}
+}
+
+func BenchmarkIPRangeGetRandomXV4(b *testing.B) {
+	cidr := "104.16.0.0/13"
+	ipr := NewIPRangeFromCIDR(&cidr)
+	r := rand.New(rand.NewSource(1))
+	b.ReportAllocs()
+	for b.Loop() {
+		if ipr.GetRandomX(r, 1) == nil {
+			ipr = NewIPRangeFromCIDR(&cidr)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"math/rand"
+)
+
+const feistelRounds = 4
+
+// Permutation is a keyed bijection on [0, max], used to draw every offset of
+// a range exactly once in random order without remembering past draws. It is
+// a balanced Feistel network over the smallest even bit width covering max,
+// with cycle walking for values that land outside the domain. Each half fits
+// in 64 bits, which covers any IPv6 range.
+type Permutation struct {
+	max  Uint128
+	half uint
+	keys [feistelRounds]uint64
+}
+
+func NewPermutation(r *rand.Rand, max Uint128) *Permutation {
+	bits := uint(max.BitLen())
+	if bits < 2 {
+		bits = 2
+	}
+	bits += bits % 2
+	p := &Permutation{max: max, half: bits / 2}
+	for i := range p.keys {
+		p.keys[i] = r.Uint64()
+	}
+	return p
+}
+
+// At returns the i'th value of the permutation, for i <= max.
+func (p *Permutation) At(i Uint128) Uint128 {
+	x := i
+	for {
+		x = p.encrypt(x)
+		if x.Cmp(p.max) <= 0 {
+			return x
+		}
+	}
+}
+
+func (p *Permutation) encrypt(x Uint128) Uint128 {
+	// for half == 64 the shift yields 0 and the mask wraps to all ones
+	mask := uint64(1)<<p.half - 1
+	l := x.Rsh(p.half).Lo
+	r := x.Lo & mask
+	for _, k := range p.keys {
+		l, r = r, (l^mix64(r^k))&mask
+	}
+	return Uint128{Lo: l}.Lsh(p.half).Add(Uint128{Lo: r})
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"net/netip"
+)
+
+// Uint128 is an unsigned 128-bit integer, wide enough for any IPv6 address
+// or offset. IPv4 addresses live in the low 32 bits.
+type Uint128 struct {
+	Hi, Lo uint64
+}
+
+func Uint128FromAddr(addr netip.Addr) Uint128 {
+	if addr.Is4() {
+		b := addr.As4()
+		return Uint128{Lo: uint64(binary.BigEndian.Uint32(b[:]))}
+	}
+	b := addr.As16()
+	return Uint128{Hi: binary.BigEndian.Uint64(b[:8]), Lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+// Addr converts u back to an address of the given family.
+func (u Uint128) Addr(is6 bool) netip.Addr {
+	if !is6 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(u.Lo))
+		return netip.AddrFrom4(b)
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.Hi)
+	binary.BigEndian.PutUint64(b[8:], u.Lo)
+	return netip.AddrFrom16(b)
+}
+
+func (u Uint128) IsZero() bool {
+	return u.Hi == 0 && u.Lo == 0
+}
+
+func (u Uint128) Cmp(v Uint128) int {
+	switch {
+	case u.Hi < v.Hi:
+		return -1
+	case u.Hi > v.Hi:
+		return 1
+	case u.Lo < v.Lo:
+		return -1
+	case u.Lo > v.Lo:
+		return 1
+	}
+	return 0
+}
+
+// Add wraps around on overflow.
+func (u Uint128) Add(v Uint128) Uint128 {
+	lo, carry := bits.Add64(u.Lo, v.Lo, 0)
+	hi, _ := bits.Add64(u.Hi, v.Hi, carry)
+	return Uint128{Hi: hi, Lo: lo}
+}
+
+func (u Uint128) Add64(v uint64) Uint128 {
+	return u.Add(Uint128{Lo: v})
+}
+
+// Sub wraps around on underflow.
+func (u Uint128) Sub(v Uint128) Uint128 {
+	lo, borrow := bits.Sub64(u.Lo, v.Lo, 0)
+	hi, _ := bits.Sub64(u.Hi, v.Hi, borrow)
+	return Uint128{Hi: hi, Lo: lo}
+}
+
+func (u Uint128) Sub64(v uint64) Uint128 {
+	return u.Sub(Uint128{Lo: v})
+}
+
+func (u Uint128) Lsh(n uint) Uint128 {
+	switch {
+	case n >= 128:
+		return Uint128{}
+	case n >= 64:
+		return Uint128{Hi: u.Lo << (n - 64)}
+	case n == 0:
+		return u
+	}
+	return Uint128{Hi: u.Hi<<n | u.Lo>>(64-n), Lo: u.Lo << n}
+}
+
+func (u Uint128) Rsh(n uint) Uint128 {
+	switch {
+	case n >= 128:
+		return Uint128{}
+	case n >= 64:
+		return Uint128{Lo: u.Hi >> (n - 64)}
+	case n == 0:
+		return u
+	}
+	return Uint128{Hi: u.Hi >> n, Lo: u.Lo>>n | u.Hi<<(64-n)}
+}
+
+func (u Uint128) BitLen() int {
+	if u.Hi != 0 {
+		return 64 + bits.Len64(u.Hi)
+	}
+	return bits.Len64(u.Lo)
+}
+
+func (u Uint128) Big() *big.Int {
+	b := new(big.Int).SetUint64(u.Hi)
+	return b.Lsh(b, 64).Or(b, new(big.Int).SetUint64(u.Lo))
+}
+
+// Uint128FromBig converts a non-negative value below 2^128.
+func Uint128FromBig(b *big.Int) Uint128 {
+	lo := new(big.Int).And(b, new(big.Int).SetUint64(^uint64(0)))
+	return Uint128{Hi: new(big.Int).Rsh(b, 64).Uint64(), Lo: lo.Uint64()}
+}